@@ -0,0 +1,351 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/kustomize/api/filesys"
+	"sigs.k8s.io/kustomize/api/types"
+	yaml2 "sigs.k8s.io/yaml"
+)
+
+// cacheKey identifies the content of an input file.
+type cacheKey struct {
+	path string
+	hash [sha256.Size]byte
+}
+
+// Cache holds the parsed kustomizations and resource files of the input tree,
+// keyed by their path and content hash. A base shared by many variants is
+// decoded once per run.
+type Cache struct {
+	mu             sync.Mutex
+	kustomizations map[cacheKey]*types.Kustomization
+	resources      map[cacheKey]map[ObjKey]*unstructured.Unstructured
+	// rendered holds the bases rendered with transformers, keyed by the
+	// content of the base directories and the transformers.
+	rendered map[string]*renderResult
+}
+
+type renderResult struct {
+	objs map[int]*unstructured.Unstructured
+	err  error
+}
+
+func NewCache() *Cache {
+	return &Cache{
+		kustomizations: map[cacheKey]*types.Kustomization{},
+		resources:      map[cacheKey]map[ObjKey]*unstructured.Unstructured{},
+		rendered:       map[string]*renderResult{},
+	}
+}
+
+func readCacheKey(filename string) (cacheKey, []byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return cacheKey{}, nil, err
+	}
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return cacheKey{}, nil, err
+	}
+	return cacheKey{path: path, hash: sha256.Sum256(data)}, data, nil
+}
+
+// LoadKustomization returns the kustomization stored in filename. The result
+// is shared and must not be modified.
+func (c *Cache) LoadKustomization(filename string) (*types.Kustomization, error) {
+	key, data, err := readCacheKey(filename)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	cfg, ok := c.kustomizations[key]
+	c.mu.Unlock()
+	if ok {
+		return cfg, nil
+	}
+
+	cfg = &types.Kustomization{}
+	err = yaml2.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.kustomizations[key] = cfg
+	c.mu.Unlock()
+	return cfg, nil
+}
+
+// LoadObjects returns the objects a variant in dir stands for. A kustomization
+// that only lists bases and resources follows the kustomizer convention of
+// listing the complete set of objects of the variant in its resources. Any
+// other kustomization is rendered by kustomize, bases included.
+func (c *Cache) LoadObjects(dir string, cfg *types.Kustomization) (map[ObjKey]*unstructured.Unstructured, error) {
+	if !IsRendered(cfg) {
+		return c.LoadResources(dir, cfg.Resources)
+	}
+	objs, err := c.buildDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	resources := make(map[ObjKey]*unstructured.Unstructured, len(objs))
+	for objKey, obj := range objs {
+		resources[objKey] = obj.DeepCopy()
+	}
+	return resources, nil
+}
+
+// IsRendered returns true if cfg uses fields other than bases and resources,
+// like transformers, generators or patches.
+func IsRendered(cfg *types.Kustomization) bool {
+	rest := *cfg
+	rest.TypeMeta = types.TypeMeta{}
+	rest.Bases = nil
+	rest.Resources = nil
+	return !reflect.DeepEqual(rest, types.Kustomization{})
+}
+
+// LoadResources decodes the objects stored in the given resource files of dir.
+// Resources that are directories hold kustomizations, which are rendered. The
+// returned objects are copies the caller may modify.
+func (c *Cache) LoadResources(dir string, files []string) (map[ObjKey]*unstructured.Unstructured, error) {
+	resources := map[ObjKey]*unstructured.Unstructured{}
+	for _, res := range files {
+		path := filepath.Join(dir, res)
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		var objs map[ObjKey]*unstructured.Unstructured
+		if info.IsDir() {
+			objs, err = c.buildDir(path)
+		} else {
+			objs, err = c.decodeFile(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for objKey, obj := range objs {
+			resources[objKey] = obj.DeepCopy()
+		}
+	}
+	return resources, nil
+}
+
+func (c *Cache) decodeFile(filename string) (map[ObjKey]*unstructured.Unstructured, error) {
+	key, data, err := readCacheKey(filename)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	objs, ok := c.resources[key]
+	c.mu.Unlock()
+	if ok {
+		return objs, nil
+	}
+
+	objs = map[ObjKey]*unstructured.Unstructured{}
+	err = DecodeResources(data, objs)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.resources[key] = objs
+	c.mu.Unlock()
+	return objs, nil
+}
+
+// BaseRenderer returns the RenderFunc of the objects of the bases in dirs,
+// which are rendered once per run for each set of transformers.
+func (c *Cache) BaseRenderer(dirs []string, base map[ObjKey]*unstructured.Unstructured) (RenderFunc, error) {
+	var keys []cacheKey
+	for _, dir := range dirs {
+		key, err := treeCacheKey(dir)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	var objs []*unstructured.Unstructured
+	for _, objKey := range SortedKeys(base) {
+		objs = append(objs, base[objKey])
+	}
+
+	return func(t Transforms) (map[int]*unstructured.Unstructured, error) {
+		data, err := json.Marshal(t)
+		if err != nil {
+			return nil, err
+		}
+		key := fmt.Sprintf("%v\x00%s", keys, data)
+		c.mu.Lock()
+		r, ok := c.rendered[key]
+		c.mu.Unlock()
+		if !ok {
+			r = &renderResult{}
+			r.objs, r.err = renderTransformed(objs, t, nil, nil, nil)
+			c.mu.Lock()
+			c.rendered[key] = r
+			c.mu.Unlock()
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		out := make(map[int]*unstructured.Unstructured, len(r.objs))
+		for i, obj := range r.objs {
+			out[i] = obj.DeepCopy()
+		}
+		return out, nil
+	}, nil
+}
+
+// buildDir renders the kustomization in dir.
+func (c *Cache) buildDir(dir string) (map[ObjKey]*unstructured.Unstructured, error) {
+	key, err := treeCacheKey(dir)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	objs, ok := c.resources[key]
+	c.mu.Unlock()
+	if ok {
+		return objs, nil
+	}
+
+	fs := flattenedFs{FileSystem: filesys.MakeFsOnDisk(), files: map[string][]byte{}}
+	err = c.flatten(dir, fs.files, sets.NewString())
+	if err != nil {
+		return nil, err
+	}
+	objs, err = Build(fs, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build resource %s: %v", dir, err)
+	}
+	c.mu.Lock()
+	c.resources[key] = objs
+	c.mu.Unlock()
+	return objs, nil
+}
+
+// flattenedFs serves the kustomization files of the input tree replaced by
+// flatten, and reads all other files from disk.
+type flattenedFs struct {
+	filesys.FileSystem
+	files map[string][]byte
+}
+
+func (fs flattenedFs) ReadFile(path string) ([]byte, error) {
+	if data, ok := fs.files[path]; ok {
+		return data, nil
+	}
+	return fs.FileSystem.ReadFile(path)
+}
+
+// flatten resolves the chain of kustomizations below dir. A kustomization
+// that only lists bases and resources already holds the complete set of its
+// objects in its resources, so kustomize must not add the objects of its bases
+// again. Its kustomization file is replaced in files by one without bases.
+// visiting holds the directories of the chain leading to dir.
+func (c *Cache) flatten(dir string, files map[string][]byte, visiting sets.String) error {
+	path, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	path, err = filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	if visiting.Has(path) {
+		return fmt.Errorf("%s is its own base", dir)
+	}
+	visiting.Insert(path)
+	defer visiting.Delete(path)
+
+	kustomization := filepath.Join(path, "kustomization.yaml")
+	cfg, err := c.LoadKustomization(kustomization)
+	if err != nil {
+		return err
+	}
+	dirs := append(append([]string{}, cfg.Resources...), cfg.Components...)
+	if !IsRendered(cfg) && len(cfg.Bases) > 0 {
+		flat := *cfg
+		flat.Bases = nil
+		data, err := yaml2.Marshal(flat)
+		if err != nil {
+			return err
+		}
+		files[kustomization] = data
+	} else {
+		dirs = append(dirs, cfg.Bases...)
+	}
+	for _, d := range dirs {
+		child := filepath.Join(path, d)
+		if _, err := os.Stat(filepath.Join(child, "kustomization.yaml")); err != nil {
+			// files and remote bases
+			continue
+		}
+		err = c.flatten(child, files, visiting)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeCacheKey returns the key of dir, hashing the paths and contents of all
+// files below it.
+func treeCacheKey(dir string) (cacheKey, error) {
+	path, err := filepath.Abs(dir)
+	if err != nil {
+		return cacheKey{}, err
+	}
+	h := sha256.New()
+	err = filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, file)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", filepath.ToSlash(rel), len(data))
+		h.Write(data)
+		return nil
+	})
+	if err != nil {
+		return cacheKey{}, err
+	}
+	key := cacheKey{path: path}
+	copy(key.hash[:], h.Sum(nil))
+	return key, nil
+}
@@ -0,0 +1,502 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCacheLoad(t *testing.T) {
+	cases := []struct {
+		name string
+		// change is applied to the input tree between the two loads
+		change map[string]string
+		// cached is true if the second load returns the results of the first
+		cached bool
+	}{
+		{
+			name:   "unchanged",
+			cached: true,
+		},
+		{
+			name:   "rewritten with the same content",
+			change: map[string]string{"base/kustomization.yaml": "resources:\n- all.yaml\n", "base/all.yaml": inferBase},
+			cached: true,
+		},
+		{
+			name:   "changed content",
+			change: map[string]string{"base/kustomization.yaml": "resources:\n- all.yaml\nnamespace: prod\n", "base/all.yaml": inferBase + "---\n" + generatedConfigMap("extra", `A: "1"`)},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rootDir := writeTree(t, map[string]string{
+				"base/kustomization.yaml": "resources:\n- all.yaml\n",
+				"base/all.yaml":           inferBase,
+			})
+			kustomization := filepath.Join(rootDir, "base", "kustomization.yaml")
+			resources := filepath.Join(rootDir, "base", "all.yaml")
+			cache := NewCache()
+			cfg, err := cache.LoadKustomization(kustomization)
+			if err != nil {
+				t.Fatal(err)
+			}
+			objs, err := cache.decodeFile(resources)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, data := range c.change {
+				if err := ioutil.WriteFile(filepath.Join(rootDir, name), []byte(data), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg2, err := cache.LoadKustomization(kustomization)
+			if err != nil {
+				t.Fatal(err)
+			}
+			objs2, err := cache.decodeFile(resources)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cached := cfg2 == cfg; cached != c.cached {
+				t.Errorf("expected cached kustomization %v, got %v", c.cached, cached)
+			}
+			if cached := reflect.ValueOf(objs2).Pointer() == reflect.ValueOf(objs).Pointer(); cached != c.cached {
+				t.Errorf("expected cached resources %v, got %v", c.cached, cached)
+			}
+			if !c.cached && (cfg2.Namespace != "prod" || len(objs2) != len(objs)+1) {
+				t.Errorf("expected the changed content, got namespace %q and %d objects", cfg2.Namespace, len(objs2))
+			}
+		})
+	}
+}
+
+func TestCacheLoadResourcesCopies(t *testing.T) {
+	rootDir := writeTree(t, map[string]string{"base/all.yaml": inferBase})
+	cache := NewCache()
+	for i := 0; i < 2; i++ {
+		resources, err := cache.LoadResources(filepath.Join(rootDir, "base"), []string{"all.yaml"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for objKey, obj := range resources {
+			if obj.GetNamespace() != "" {
+				t.Fatalf("%v was modified by a caller", objKey)
+			}
+			obj.SetNamespace("prod")
+		}
+	}
+}
+
+func TestTreeCacheKey(t *testing.T) {
+	cases := []struct {
+		name string
+		// change is applied to the tree, files with empty content are removed
+		change map[string]string
+		same   bool
+	}{
+		{
+			name: "unchanged",
+			same: true,
+		},
+		{
+			name:   "rewritten with the same content",
+			change: map[string]string{"nested/all.yaml": inferBase},
+			same:   true,
+		},
+		{
+			name:   "changed nested file",
+			change: map[string]string{"nested/all.yaml": inferBase + "---\n"},
+		},
+		{
+			name:   "added file",
+			change: map[string]string{"extra.yaml": inferBase},
+		},
+		{
+			name:   "renamed file",
+			change: map[string]string{"nested/all.yaml": "", "nested/other.yaml": inferBase},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rootDir := writeTree(t, map[string]string{
+				"kustomization.yaml":        "resources:\n- nested\n",
+				"nested/kustomization.yaml": "resources:\n- all.yaml\n",
+				"nested/all.yaml":           inferBase,
+			})
+			key, err := treeCacheKey(rootDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, data := range c.change {
+				path := filepath.Join(rootDir, name)
+				if data == "" {
+					err = os.Remove(path)
+				} else {
+					err = ioutil.WriteFile(path, []byte(data), 0o644)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			key2, err := treeCacheKey(rootDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if same := key2 == key; same != c.same {
+				t.Errorf("expected the same key %v, got %v", c.same, same)
+			}
+		})
+	}
+}
+
+func TestBaseRenderer(t *testing.T) {
+	cases := []struct {
+		name string
+		// dirs are the base directories of each render
+		dirs []string
+		// transforms are rendered in order with the base of the same index
+		transforms []Transforms
+		// renders is the number of renders run by kustomize
+		renders int
+	}{
+		{
+			name:       "same transformers",
+			dirs:       []string{"a", "a"},
+			transforms: []Transforms{{Namespace: "prod"}, {Namespace: "prod"}},
+			renders:    1,
+		},
+		{
+			name:       "other transformers",
+			dirs:       []string{"a", "a"},
+			transforms: []Transforms{{Namespace: "prod"}, {Namespace: "dev"}},
+			renders:    2,
+		},
+		{
+			name:       "other base with the same objects",
+			dirs:       []string{"a", "b"},
+			transforms: []Transforms{{Namespace: "prod"}, {Namespace: "prod"}},
+			renders:    2,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rootDir := writeTree(t, map[string]string{"a/all.yaml": inferBase, "b/all.yaml": inferBase})
+			cache := NewCache()
+			for i, dir := range c.dirs {
+				base := decodeObjects(t, inferBase)
+				render, err := cache.BaseRenderer([]string{filepath.Join(rootDir, dir)}, base)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rendered, err := render(c.transforms[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				for j, objKey := range SortedKeys(base) {
+					if ns := rendered[j].GetNamespace(); ns != c.transforms[i].Namespace {
+						t.Errorf("render %d: expected %v in namespace %q, got %q", i, objKey, c.transforms[i].Namespace, ns)
+					}
+					// results are copies the caller may modify
+					rendered[j].SetNamespace("changed")
+				}
+			}
+			if len(cache.rendered) != c.renders {
+				t.Errorf("expected %d renders, got %d", c.renders, len(cache.rendered))
+			}
+		})
+	}
+}
+
+func TestLoadResourcesDirs(t *testing.T) {
+	files := map[string]string{
+		"all.yaml":                         inferBase,
+		"extra.yaml":                       generatedConfigMap("extra", `A: "1"`),
+		"prod/kustomization.yaml":          "namespace: prod\nresources:\n- all.yaml\n",
+		"prod/all.yaml":                    inferBase,
+		"prefixed/kustomization.yaml":      "namePrefix: a-\nresources:\n- prod\n",
+		"prefixed/prod/kustomization.yaml": "namespace: prod\nresources:\n- extra.yaml\n",
+		"prefixed/prod/extra.yaml":         generatedConfigMap("extra", `A: "1"`),
+		"empty/all.yaml":                   inferBase,
+	}
+	cases := []struct {
+		name      string
+		resources []string
+		// objects are the keys of the loaded objects as namespace/name
+		objects []string
+		invalid bool
+	}{
+		{
+			name:      "files",
+			resources: []string{"all.yaml", "extra.yaml"},
+			objects:   []string{"/config", "/extra", "/web", "/web"},
+		},
+		{
+			name:      "directory with its own transformers",
+			resources: []string{"prod"},
+			objects:   []string{"prod/config", "prod/web", "prod/web"},
+		},
+		{
+			name:      "nested directories",
+			resources: []string{"prefixed"},
+			objects:   []string{"prod/a-extra"},
+		},
+		{
+			name:      "files and directories",
+			resources: []string{"extra.yaml", "prod"},
+			objects:   []string{"/extra", "prod/config", "prod/web", "prod/web"},
+		},
+		{
+			name:      "directory without kustomization",
+			resources: []string{"empty"},
+			invalid:   true,
+		},
+		{
+			name:      "missing file",
+			resources: []string{"missing.yaml"},
+			invalid:   true,
+		},
+	}
+
+	rootDir := writeTree(t, files)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resources, err := NewCache().LoadResources(rootDir, c.resources)
+			if c.invalid {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var objects []string
+			for _, objKey := range SortedKeys(resources) {
+				obj := resources[objKey]
+				objects = append(objects, obj.GetNamespace()+"/"+obj.GetName())
+			}
+			sort.Strings(objects)
+			if !reflect.DeepEqual(objects, c.objects) {
+				t.Errorf("expected %v, got %v", c.objects, objects)
+			}
+		})
+	}
+}
+
+func TestVerifyResourceDirs(t *testing.T) {
+	cases := []struct {
+		name    string
+		variant map[string]string
+	}{
+		{
+			name: "directory",
+			variant: map[string]string{
+				"kustomization.yaml":      "bases:\n- ../../base\nresources:\n- all.yaml\n- prod\n",
+				"all.yaml":                inferBase,
+				"prod/kustomization.yaml": "namespace: prod\nresources:\n- extra.yaml\n",
+				"prod/extra.yaml":         generatedConfigMap("extra", `A: "1"`),
+			},
+		},
+		{
+			name: "directory holding the base objects",
+			variant: map[string]string{
+				"kustomization.yaml":      "bases:\n- ../../base\nresources:\n- prod\n",
+				"prod/kustomization.yaml": "namespace: prod\nresources:\n- all.yaml\n",
+				"prod/all.yaml":           inferBase,
+			},
+		},
+		{
+			name: "nested directories",
+			variant: map[string]string{
+				"kustomization.yaml":        "bases:\n- ../../base\nresources:\n- all.yaml\n- a\n",
+				"all.yaml":                  inferBase,
+				"a/kustomization.yaml":      "namePrefix: a-\nresources:\n- prod\n",
+				"a/prod/kustomization.yaml": "namespace: prod\nresources:\n- extra.yaml\n",
+				"a/prod/extra.yaml":         generatedConfigMap("extra", `A: "1"`),
+			},
+		},
+	}
+
+	for _, c := range cases {
+		for _, outputSchema := range []OutputSchema{OutputSchemaLegacy, OutputSchemaUnified} {
+			t.Run(c.name+"/"+string(outputSchema), func(t *testing.T) {
+				files := map[string]string{
+					"base/kustomization.yaml": "resources:\n- all.yaml\n",
+					"base/all.yaml":           inferBase,
+				}
+				for name, data := range c.variant {
+					files["variants/a/"+name] = data
+				}
+				p := processTree(t, newProcessor(outputSchema), files, Variable{Base: "base"}, Variable{Dir: "variants"})
+				if err := p.Verify(); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
+
+func TestLoadObjectsChains(t *testing.T) {
+	files := map[string]string{
+		"base/kustomization.yaml":     "resources:\n- all.yaml\n",
+		"base/all.yaml":               inferBase,
+		"plain/kustomization.yaml":    "bases:\n- ../base\nresources:\n- all.yaml\n",
+		"plain/all.yaml":              inferBase + "---\n" + generatedConfigMap("extra", `A: "1"`),
+		"rendered/kustomization.yaml": "bases:\n- ../plain\nnamespace: prod\n",
+		"chain/kustomization.yaml":    "bases:\n- ../rendered\nnamePrefix: a-\n",
+		"mixed/kustomization.yaml":    "bases:\n- ../chain\nresources:\n- all.yaml\n",
+		"mixed/all.yaml":              generatedConfigMap("extra", `A: "1"`),
+		"top/kustomization.yaml":      "bases:\n- ../mixed\nnameSuffix: -v2\n",
+		"loop/a/kustomization.yaml":   "bases:\n- ../b\nnamespace: a\n",
+		"loop/b/kustomization.yaml":   "bases:\n- ../a\nnamespace: b\n",
+	}
+	cases := []struct {
+		name string
+		dir  string
+		// objects are the keys of the loaded objects as namespace/name
+		objects []string
+		invalid bool
+	}{
+		{
+			name:    "plain variant",
+			dir:     "plain",
+			objects: []string{"/config", "/extra", "/web", "/web"},
+		},
+		{
+			name:    "rendered variant of a plain base",
+			dir:     "rendered",
+			objects: []string{"prod/config", "prod/extra", "prod/web", "prod/web"},
+		},
+		{
+			name:    "rendered chain",
+			dir:     "chain",
+			objects: []string{"prod/a-config", "prod/a-extra", "prod/a-web", "prod/a-web"},
+		},
+		{
+			name:    "plain base in a rendered chain",
+			dir:     "top",
+			objects: []string{"/extra-v2"},
+		},
+		{
+			name:    "base referring back to itself",
+			dir:     "loop/a",
+			invalid: true,
+		},
+	}
+
+	rootDir := writeTree(t, files)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cache := NewCache()
+			dir := filepath.Join(rootDir, c.dir)
+			cfg, err := cache.LoadKustomization(filepath.Join(dir, "kustomization.yaml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resources, err := cache.LoadObjects(dir, cfg)
+			if c.invalid {
+				if err == nil || !strings.Contains(err.Error(), "is its own base") {
+					t.Errorf("expected a base referring back to itself, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var objects []string
+			for _, obj := range resources {
+				objects = append(objects, obj.GetNamespace()+"/"+obj.GetName())
+			}
+			sort.Strings(objects)
+			if !reflect.DeepEqual(objects, c.objects) {
+				t.Errorf("expected %v, got %v", c.objects, objects)
+			}
+		})
+	}
+}
+
+func TestVerifyChains(t *testing.T) {
+	cases := []struct {
+		name string
+		// mid is the kustomization of the variant used as base of the variant
+		mid     map[string]string
+		variant map[string]string
+	}{
+		{
+			name: "rendered variant of a plain base",
+			mid: map[string]string{
+				"kustomization.yaml": "bases:\n- ../../base\nresources:\n- all.yaml\n",
+				"all.yaml":           inferBase + "---\n" + generatedConfigMap("extra", `A: "1"`),
+			},
+			variant: map[string]string{
+				"kustomization.yaml": "bases:\n- ../../mids/m\nnamespace: prod\n",
+			},
+		},
+		{
+			name: "rendered variant of a rendered base",
+			mid: map[string]string{
+				"kustomization.yaml": "bases:\n- ../../base\nnamePrefix: a-\n",
+			},
+			variant: map[string]string{
+				"kustomization.yaml": "bases:\n- ../../mids/m\nnamespace: prod\n",
+			},
+		},
+		{
+			name: "plain variant of a rendered base",
+			mid: map[string]string{
+				"kustomization.yaml": "bases:\n- ../../base\nnamespace: prod\n",
+			},
+			variant: map[string]string{
+				"kustomization.yaml": "bases:\n- ../../mids/m\nresources:\n- all.yaml\n",
+				"all.yaml":           strings.Replace(inferBase, "  name: web\n", "  name: web\n  namespace: prod\n", -1),
+			},
+		},
+	}
+
+	for _, c := range cases {
+		for _, outputSchema := range []OutputSchema{OutputSchemaLegacy, OutputSchemaUnified} {
+			t.Run(c.name+"/"+string(outputSchema), func(t *testing.T) {
+				files := map[string]string{
+					"base/kustomization.yaml": "resources:\n- all.yaml\n",
+					"base/all.yaml":           inferBase,
+				}
+				for name, data := range c.mid {
+					files["mids/m/"+name] = data
+				}
+				for name, data := range c.variant {
+					files["variants/v/"+name] = data
+				}
+				p := processTree(t, newProcessor(outputSchema), files,
+					Variable{Base: "base"}, Variable{Dir: "mids"}, Variable{Dir: "variants"})
+				if err := p.Verify(); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/kustomize/api/filesys"
+)
+
+// Check compares the files generated by the processor with the contents of
+// dstDir on disk and returns an error if they differ. If only some profiles
+// were processed, skip holds the entries of dstDir generated by the others,
+// whose files on disk are not compared.
+func (p *Processor) Check(dstDir string, skip *OutputDirs) error {
+	generated, err := readTree(p.fs, dstDir)
+	if err != nil {
+		return err
+	}
+	existing := map[string][]byte{}
+	if _, err := os.Stat(dstDir); err == nil {
+		existing, err = readTree(filesys.MakeFsOnDisk(), dstDir)
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var diffs []string
+	for path, data := range generated {
+		old, ok := existing[path]
+		if !ok {
+			diffs = append(diffs, "added:   "+path)
+		} else if !bytes.Equal(old, data) {
+			diffs = append(diffs, "changed: "+path)
+		}
+	}
+	for path := range existing {
+		if skip != nil && skip.Has(strings.SplitN(path, "/", 2)[0]) {
+			continue
+		}
+		if _, ok := generated[path]; !ok {
+			diffs = append(diffs, "stale:   "+path)
+		}
+	}
+	if len(diffs) == 0 {
+		fmt.Println(dstDir, "is up to date")
+		return nil
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i][9:] < diffs[j][9:]
+	})
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	return fmt.Errorf("%s is out of date, %d files differ", dstDir, len(diffs))
+}
+
+// readTree returns the contents of the files under dir keyed by their path
+// relative to dir.
+func readTree(fs filesys.FileSystem, dir string) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	err := fs.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		data, err := fs.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = data
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
@@ -0,0 +1,125 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/kustomize/api/filesys"
+)
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		name      string
+		existing  map[string]string
+		generated map[string]string
+		// skip lists the entries of the output directory generated by the
+		// profiles that were not processed, if any
+		skip     []string
+		shared   bool
+		upToDate bool
+	}{
+		{
+			name:      "up to date",
+			existing:  map[string]string{"a/base/kustomization.yaml": "x"},
+			generated: map[string]string{"a/base/kustomization.yaml": "x"},
+			upToDate:  true,
+		},
+		{
+			name:      "changed",
+			existing:  map[string]string{"a/base/kustomization.yaml": "x"},
+			generated: map[string]string{"a/base/kustomization.yaml": "y"},
+		},
+		{
+			name:      "other profile",
+			existing:  map[string]string{"a/base/kustomization.yaml": "x", "b/base/kustomization.yaml": "x"},
+			generated: map[string]string{"a/base/kustomization.yaml": "x"},
+		},
+		{
+			name:      "other profile not processed",
+			existing:  map[string]string{"a/base/kustomization.yaml": "x", "b/base/kustomization.yaml": "x"},
+			generated: map[string]string{"a/base/kustomization.yaml": "x"},
+			skip:      []string{"b"},
+			upToDate:  true,
+		},
+		{
+			name:      "stale file of processed profile",
+			existing:  map[string]string{"a/base/kustomization.yaml": "x", "a/base/old.yaml": "x"},
+			generated: map[string]string{"a/base/kustomization.yaml": "x"},
+			skip:      []string{"b"},
+		},
+		{
+			name: "removed variant of processed profile",
+			existing: map[string]string{
+				"base/kustomization.yaml":  "x",
+				"dev/kustomization.yaml":   "x",
+				"old/kustomization.yaml":   "x",
+				"other/kustomization.yaml": "x",
+			},
+			generated: map[string]string{"base/kustomization.yaml": "x", "dev/kustomization.yaml": "x"},
+			skip:      []string{"other"},
+		},
+		{
+			name: "shared directories of other profile",
+			existing: map[string]string{
+				"a/base/kustomization.yaml":        "x",
+				"common/kustomization.yaml":        "x",
+				"_components/1/kustomization.yaml": "x",
+			},
+			generated: map[string]string{"a/base/kustomization.yaml": "x"},
+			skip:      []string{"b"},
+			shared:    true,
+			upToDate:  true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dstDir := t.TempDir()
+			for name, content := range c.existing {
+				path := filepath.Join(dstDir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(path, []byte(content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			fs := filesys.MakeFsInMemory()
+			for name, content := range c.generated {
+				if err := fs.WriteFile(filepath.Join(dstDir, name), []byte(content)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var skip *OutputDirs
+			if c.skip != nil {
+				skip = &OutputDirs{names: sets.NewString(c.skip...), shared: c.shared}
+			}
+			err := NewProcessor(fs).Check(dstDir, skip)
+			if c.upToDate && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if !c.upToDate && err == nil {
+				t.Error("expected the output to be out of date")
+			}
+		})
+	}
+}
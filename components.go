@@ -0,0 +1,217 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// componentsDir is the directory below the parent of sibling overlays that
+// holds the components extracted from them.
+const componentsDir = "components"
+
+// commonDir is the directory below the parent of sibling overlays that holds
+// the intermediate base with the patches all of them have in common.
+const commonDir = "common"
+
+// patchKey identifies identical patches of overlays that share their bases.
+func patchKey(o *Overlay, patch *OverlayPatch) string {
+	return fmt.Sprintf("%s\x00%t\x00%v\x00%s", strings.Join(o.Bases, ","), patch.JSON, patch.Target, patch.Data)
+}
+
+// shareable returns true if patch can be moved to a component. Legacy
+// JSON patches target the objects after the transformers of the overlay,
+// which run after its components, so they are only moved if the transformers
+// do not change the patched object. Renames stay in the overlay, after the
+// patches using the old name of the object.
+func shareable(patch *OverlayPatch) bool {
+	return !(patch.JSON && patch.Transformed) && !patch.Rename
+}
+
+// sharedPatches indexes the shareable patches of the sibling overlays.
+type sharedPatches struct {
+	siblings map[string]*Overlay
+	// keys lists the patches in the order they were found.
+	keys    []string
+	patches map[string]*OverlayPatch
+	// users maps every patch to the sorted names of the siblings that have it.
+	users map[string][]string
+}
+
+func newSharedPatches(siblings map[string]*Overlay) *sharedPatches {
+	s := &sharedPatches{
+		siblings: siblings,
+		patches:  map[string]*OverlayPatch{},
+		users:    map[string][]string{},
+	}
+	names := make([]string, 0, len(siblings))
+	for name := range siblings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o := siblings[name]
+		if o.Copied {
+			continue
+		}
+		for _, patch := range o.Patches {
+			if !shareable(patch) {
+				continue
+			}
+			key := patchKey(o, patch)
+			if _, ok := s.patches[key]; !ok {
+				s.patches[key] = patch
+				s.keys = append(s.keys, key)
+			}
+			s.users[key] = append(s.users[key], name)
+		}
+	}
+	return s
+}
+
+// move moves the patches with the given keys from their users to dst.
+func (s *sharedPatches) move(dst *Overlay, keys []string) {
+	var candidates [][]string
+	for _, key := range keys {
+		candidates = append(candidates, s.patches[key].Names)
+	}
+	namer := newFileNamer(candidates)
+
+	for _, key := range keys {
+		patch := *s.patches[key]
+		patch.Path = namer.Name(patch.Names)
+		dst.AddPatch(&patch)
+		for _, name := range s.users[key] {
+			o := s.siblings[name]
+			for _, p := range o.Patches {
+				if patchKey(o, p) == key {
+					o.RemovePatch(p.Path)
+					break
+				}
+			}
+			if dst.needsSchema() && dst.Cfg.OpenAPI == nil {
+				dst.Cfg.OpenAPI = o.Cfg.OpenAPI
+				dst.Files[openAPIFilename] = o.Files[openAPIFilename]
+			}
+		}
+	}
+}
+
+// sharedDir returns a directory name below the parent of the siblings that
+// does not clash with any of them.
+func sharedDir(name string, siblings map[string]*Overlay) string {
+	for sets.StringKeySet(siblings).Has(name) {
+		name = "_" + name
+	}
+	return name
+}
+
+// ExtractComponents moves the patches that sibling overlays generated below
+// dir have in common into components, which are referenced from the overlays
+// instead. Patches shared by the same set of siblings are written to one
+// component, numbered in the order of the sorted sets after the components
+// already extracted below dir. The planned components are returned.
+func (p *Processor) ExtractComponents(dir string, siblings map[string]*Overlay) []*Overlay {
+	s := newSharedPatches(siblings)
+
+	// group the patches by the set of siblings using them, sibling names can
+	// not contain NUL
+	groups := map[string][]string{}
+	var groupKeys []string
+	for _, key := range s.keys {
+		if len(s.users[key]) < 2 {
+			continue
+		}
+		group := strings.Join(s.users[key], "\x00")
+		if _, ok := groups[group]; !ok {
+			groupKeys = append(groupKeys, group)
+		}
+		groups[group] = append(groups[group], key)
+	}
+	sort.Strings(groupKeys)
+
+	root := filepath.Join(dir, sharedDir(componentsDir, siblings))
+	var components []*Overlay
+	n := 1
+	for _, group := range groupKeys {
+		// the siblings of a fork share root with the siblings processed before
+		for !p.claim(filepath.Join(root, strconv.Itoa(n))) {
+			n++
+		}
+		c := &Overlay{
+			Dir:       filepath.Join(root, strconv.Itoa(n)),
+			Exact:     true,
+			Component: true,
+			Files:     map[string][]byte{},
+		}
+		s.move(c, groups[group])
+		for _, name := range strings.Split(group, "\x00") {
+			o := siblings[name]
+			o.Components = append(o.Components, c.Dir)
+		}
+		components = append(components, c)
+	}
+	return components
+}
+
+// HoistCommonPatches moves the patches that all sibling overlays generated
+// below dir have in common into an intermediate base, on which the overlays
+// are re-rooted. It returns nil if the siblings share no patch.
+func (p *Processor) HoistCommonPatches(dir string, siblings map[string]*Overlay) *Overlay {
+	if len(siblings) < 2 {
+		return nil
+	}
+	s := newSharedPatches(siblings)
+	var keys []string
+	for _, key := range s.keys {
+		if len(s.users[key]) == len(siblings) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	var bases []string
+	for _, o := range siblings {
+		// all siblings have the same bases, as they are part of the key
+		bases = o.Bases
+		break
+	}
+	// the siblings of a fork share dir with the siblings processed before
+	name := sharedDir(commonDir, siblings)
+	for !p.claim(filepath.Join(dir, name)) {
+		name = sharedDir("_"+name, siblings)
+	}
+	common := &Overlay{
+		Dir:   filepath.Join(dir, name),
+		Exact: true,
+		Bases: bases,
+		Files: map[string][]byte{},
+	}
+	s.move(common, keys)
+	for _, o := range siblings {
+		o.Bases = []string{common.Dir}
+	}
+	return common
+}
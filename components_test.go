@@ -0,0 +1,226 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/kustomize/api/filesys"
+)
+
+// newSiblings returns overlays with the same base, each with a strategic merge
+// patch per entry of patches.
+func newSiblings(patches map[string][]string) map[string]*Overlay {
+	siblings := map[string]*Overlay{}
+	for name, data := range patches {
+		o := &Overlay{
+			Dir:   filepath.Join("/out", name),
+			Bases: []string{"/out/base"},
+			Files: map[string][]byte{},
+		}
+		for _, d := range data {
+			o.AddPatch(&OverlayPatch{Path: d + ".yaml", Names: []string{d}, Data: []byte(d)})
+		}
+		siblings[name] = o
+	}
+	return siblings
+}
+
+func TestExtractComponents(t *testing.T) {
+	many := map[string][]string{}
+	for i := 10; i < 100; i++ {
+		many[fmt.Sprintf("mysql-%d", i)] = []string{"shared"}
+	}
+
+	cases := []struct {
+		name    string
+		patches map[string][]string
+		// components lists the patches of every expected component
+		components [][]string
+	}{
+		{
+			name: "sibling sets with the same joined name",
+			patches: map[string][]string{
+				"a":   {"x"},
+				"a-b": {"y"},
+				"b-c": {"x"},
+				"c":   {"y"},
+			},
+			components: [][]string{{"x"}, {"y"}},
+		},
+		{
+			name:       "many siblings",
+			patches:    many,
+			components: [][]string{{"shared"}},
+		},
+		{
+			name: "patches of one sibling",
+			patches: map[string][]string{
+				"a": {"x"},
+				"b": {"y"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			siblings := newSiblings(c.patches)
+			components := NewProcessor(filesys.MakeFsInMemory()).ExtractComponents("/out", siblings)
+
+			var got [][]string
+			byDir := map[string]*Overlay{}
+			for _, comp := range components {
+				if n := len(filepath.Base(comp.Dir)); n > 16 {
+					t.Errorf("component directory %s has a name of %d characters", comp.Dir, n)
+				}
+				if _, ok := byDir[comp.Dir]; ok {
+					t.Errorf("component directory %s is used twice", comp.Dir)
+				}
+				byDir[comp.Dir] = comp
+				var data []string
+				for _, patch := range comp.Patches {
+					data = append(data, string(patch.Data))
+				}
+				got = append(got, data)
+			}
+			sort.Slice(got, func(i, j int) bool { return fmt.Sprint(got[i]) < fmt.Sprint(got[j]) })
+			if !reflect.DeepEqual(got, c.components) {
+				t.Errorf("components: got %v, want %v", got, c.components)
+			}
+
+			// every sibling still applies its own patches, either directly or
+			// through its components
+			for name, want := range c.patches {
+				o := siblings[name]
+				var applied []string
+				for _, patch := range o.Patches {
+					applied = append(applied, string(patch.Data))
+				}
+				for _, dir := range o.Components {
+					comp, ok := byDir[dir]
+					if !ok {
+						t.Fatalf("%s refers to unknown component %s", name, dir)
+					}
+					for _, patch := range comp.Patches {
+						applied = append(applied, string(patch.Data))
+					}
+				}
+				sort.Strings(applied)
+				if !reflect.DeepEqual(applied, want) {
+					t.Errorf("%s: applies %v, want %v", name, applied, want)
+				}
+			}
+		})
+	}
+}
+
+const forkBase = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  selector:
+    matchLabels:
+      app: web
+  template:
+    metadata:
+      labels:
+        app: web
+    spec:
+      containers:
+      - name: web
+        image: nginx
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+spec:
+  ports:
+  - port: 80
+`
+
+// forkVariant returns the files of a variant below dir that sets the env var
+// of the Deployment or the port of the Service, if not empty.
+func forkVariant(dir, env, port string) map[string]string {
+	data := forkBase
+	if env != "" {
+		data = strings.Replace(data, "        image: nginx\n", "        image: nginx\n        env:\n        - name: TLS\n          value: "+env+"\n", 1)
+	}
+	if port != "" {
+		data = strings.Replace(data, "  - port: 80\n", "  - port: "+port+"\n", 1)
+	}
+	return map[string]string{
+		dir + "/kustomization.yaml": "bases:\n- ../../base\nresources:\n- all.yaml\n",
+		dir + "/all.yaml":           data,
+	}
+}
+
+func TestSharedDirsOfForks(t *testing.T) {
+	cases := []struct {
+		name     string
+		variants []map[string]string
+	}{
+		{
+			name: "common bases",
+			variants: []map[string]string{
+				forkVariant("v/a", "on", ""),
+				forkVariant("v/b", "on", ""),
+				forkVariant("w/x", "", "443"),
+				forkVariant("w/y", "", "443"),
+			},
+		},
+		{
+			name: "components",
+			variants: []map[string]string{
+				forkVariant("v/a", "on", ""),
+				forkVariant("v/b", "on", ""),
+				forkVariant("v/c", "off", ""),
+				forkVariant("w/x", "", "443"),
+				forkVariant("w/y", "", "443"),
+				forkVariant("w/z", "", "8443"),
+			},
+		},
+	}
+
+	for _, c := range cases {
+		for _, outputSchema := range []OutputSchema{OutputSchemaLegacy, OutputSchemaUnified} {
+			t.Run(c.name+"/"+string(outputSchema), func(t *testing.T) {
+				files := map[string]string{
+					"base/kustomization.yaml": "resources:\n- all.yaml\n",
+					"base/all.yaml":           forkBase,
+				}
+				for _, v := range c.variants {
+					for name, data := range v {
+						files[name] = data
+					}
+				}
+				p := processTree(t, newProcessor(outputSchema), files,
+					Variable{Base: "base"}, Variable{Dir: "v", Fork: true}, Variable{Dir: "w"})
+				if err := p.Verify(); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
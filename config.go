@@ -0,0 +1,226 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	yaml2 "sigs.k8s.io/yaml"
+)
+
+const (
+	KustomizerVersion = "kustomizer.kmodules.xyz/v1alpha1"
+	KustomizerKind    = "Kustomizer"
+)
+
+// LoadKustomizer reads and validates the kustomizer.yaml file. Unknown fields
+// are rejected.
+func LoadKustomizer(filename string) (*Kustomizer, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	// encoding/json matches field names case insensitively, so a misspelled
+	// field like Dir is checked separately
+	var raw interface{}
+	err = yaml2.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", filename, err)
+	}
+	if errs := unknownFields(raw, reflect.TypeOf(Kustomizer{}), ""); len(errs) > 0 {
+		return nil, fmt.Errorf("failed to decode %s: %v", filename, utilerrors.NewAggregate(errs))
+	}
+	var cfg Kustomizer
+	err = yaml2.UnmarshalStrict(data, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", filename, err)
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", filename, err)
+	}
+	return &cfg, nil
+}
+
+// ProfileNames returns the sorted names of the profiles matching any of the
+// glob patterns, or of all profiles if no pattern is given. Every pattern
+// must match at least one profile.
+func (k *Kustomizer) ProfileNames(patterns []string) ([]string, error) {
+	names := make([]string, 0, len(k.Profiles))
+	for name := range k.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(patterns) == 0 {
+		return names, nil
+	}
+
+	selected := sets.NewString()
+	for _, pattern := range patterns {
+		var found bool
+		for _, name := range names {
+			ok, err := path.Match(pattern, name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid profile pattern %q: %v", pattern, err)
+			}
+			if ok {
+				selected.Insert(name)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no profile matches %q, found %s", pattern, strings.Join(names, ", "))
+		}
+	}
+	return selected.List(), nil
+}
+
+// unknownFields returns an error for every key of the decoded YAML value v
+// that does not exactly match a JSON field name of the type t.
+func unknownFields(v interface{}, t reflect.Type, path string) []error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var errs []error
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := map[string]reflect.Type{}
+		jsonFields(t, fields)
+		for _, k := range sortedKeys(m) {
+			child := m[k]
+			ft, ok := fields[k]
+			if !ok {
+				errs = append(errs, fmt.Errorf("unknown field %q", strings.TrimPrefix(path+"."+k, ".")))
+				continue
+			}
+			errs = append(errs, unknownFields(child, ft, path+"."+k)...)
+		}
+	case reflect.Map:
+		if m, ok := v.(map[string]interface{}); ok {
+			for _, k := range sortedKeys(m) {
+				errs = append(errs, unknownFields(m[k], t.Elem(), path+"."+k)...)
+			}
+		}
+	case reflect.Slice:
+		if items, ok := v.([]interface{}); ok {
+			for i, item := range items {
+				errs = append(errs, unknownFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	}
+	return errs
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsonFields collects the JSON field names of the struct type t, including
+// those of inlined structs.
+func jsonFields(t reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		switch {
+		case name == "-":
+		case name == "" && f.Anonymous:
+			jsonFields(f.Type, fields)
+		case name == "":
+			fields[f.Name] = f.Type
+		default:
+			fields[name] = f.Type
+		}
+	}
+}
+
+// Validate checks the version of the configuration and every variable of its
+// profiles, which must not list the same directory twice. Files without apiVersion and kind are accepted as the first
+// version.
+func (k *Kustomizer) Validate() error {
+	var errs []error
+	if k.APIVersion != "" && k.APIVersion != KustomizerVersion {
+		errs = append(errs, fmt.Errorf("unsupported apiVersion %q, must be %s", k.APIVersion, KustomizerVersion))
+	}
+	if k.Kind != "" && k.Kind != KustomizerKind {
+		errs = append(errs, fmt.Errorf("unsupported kind %q, must be %s", k.Kind, KustomizerKind))
+	}
+	if err := k.OutputSchema.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(k.Profiles) == 0 {
+		errs = append(errs, fmt.Errorf("no profiles defined"))
+	}
+
+	names, _ := k.ProfileNames(nil)
+	for _, name := range names {
+		profile := k.Profiles[name]
+		if len(profile) == 0 {
+			errs = append(errs, fmt.Errorf("profiles.%s: no variables defined", name))
+		}
+		// a directory listed twice would be generated below itself
+		used := map[Variable]int{}
+		for i, v := range profile {
+			if err := v.Validate(i, len(profile)); err != nil {
+				errs = append(errs, fmt.Errorf("profiles.%s[%d]: %v", name, i, err))
+				continue
+			}
+			dir := Variable{Base: v.Base, Dir: v.Dir}
+			if j, ok := used[dir]; ok {
+				field, value := "base", v.Base
+				if v.Dir != "" {
+					field, value = "dir", v.Dir
+				}
+				errs = append(errs, fmt.Errorf("profiles.%s[%d]: %s %q is already used by profiles.%s[%d]", name, i, field, value, name, j))
+				continue
+			}
+			used[dir] = i
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// Validate checks the variable found at index i of a profile with n
+// variables.
+func (v Variable) Validate(i, n int) error {
+	switch {
+	case v.Base != "" && v.Dir != "":
+		return fmt.Errorf("base %q and dir %q are both set, use one of them", v.Base, v.Dir)
+	case v.Base == "" && v.Dir == "":
+		return fmt.Errorf("one of base or dir must be set")
+	case v.Fork && (i == 0 || i == n-1):
+		// the variables following a forked variable are also applied
+		// directly to the variable before it
+		return fmt.Errorf("fork has no effect on the first or last variable")
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	yaml2 "sigs.k8s.io/yaml"
+)
+
+func TestVariableValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		v    Variable
+		i, n int
+		err  string
+	}{
+		{
+			name: "base",
+			v:    Variable{Base: "base"},
+			n:    1,
+		},
+		{
+			name: "dir",
+			v:    Variable{Dir: "variants"},
+			i:    1,
+			n:    2,
+		},
+		{
+			name: "base and dir",
+			v:    Variable{Base: "base", Dir: "variants"},
+			n:    1,
+			err:  `base "base" and dir "variants" are both set, use one of them`,
+		},
+		{
+			name: "neither base nor dir",
+			v:    Variable{Fork: true},
+			i:    1,
+			n:    3,
+			err:  "one of base or dir must be set",
+		},
+		{
+			name: "forked",
+			v:    Variable{Dir: "variants", Fork: true},
+			i:    1,
+			n:    3,
+		},
+		{
+			name: "forked first variable",
+			v:    Variable{Dir: "variants", Fork: true},
+			n:    3,
+			err:  "fork has no effect on the first or last variable",
+		},
+		{
+			name: "forked last variable",
+			v:    Variable{Dir: "variants", Fork: true},
+			i:    2,
+			n:    3,
+			err:  "fork has no effect on the first or last variable",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var msg string
+			if err := c.v.Validate(c.i, c.n); err != nil {
+				msg = err.Error()
+			}
+			if msg != c.err {
+				t.Errorf("expected error %q, got %q", c.err, msg)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  Kustomizer
+		errs []string
+	}{
+		{
+			name: "valid",
+			cfg: Kustomizer{
+				TypeMeta: metav1.TypeMeta{APIVersion: KustomizerVersion, Kind: KustomizerKind},
+				Profiles: map[string]Profile{"default": {{Base: "base"}, {Dir: "variants"}}},
+			},
+		},
+		{
+			name: "first version without apiVersion and kind",
+			cfg: Kustomizer{
+				Profiles: map[string]Profile{"default": {{Base: "base"}}},
+			},
+		},
+		{
+			name: "unsupported version",
+			cfg: Kustomizer{
+				TypeMeta:     metav1.TypeMeta{APIVersion: "kustomizer.kmodules.xyz/v2", Kind: "Kustomization"},
+				Profiles:     map[string]Profile{"default": {{Base: "base"}}},
+				OutputSchema: "latest",
+			},
+			errs: []string{
+				`unsupported apiVersion "kustomizer.kmodules.xyz/v2", must be kustomizer.kmodules.xyz/v1alpha1`,
+				`unsupported kind "Kustomization", must be Kustomizer`,
+				`unknown output schema "latest", must be one of legacy or unified`,
+			},
+		},
+		{
+			name: "no profiles",
+			errs: []string{"no profiles defined"},
+		},
+		{
+			name: "invalid variables",
+			cfg: Kustomizer{
+				Profiles: map[string]Profile{
+					"b":     {{Base: "base"}, {}},
+					"a":     {{Base: "base", Dir: "variants"}},
+					"empty": {},
+				},
+			},
+			errs: []string{
+				`profiles.a[0]: base "base" and dir "variants" are both set, use one of them`,
+				"profiles.b[1]: one of base or dir must be set",
+				"profiles.empty: no variables defined",
+			},
+		},
+		{
+			name: "duplicate variables",
+			cfg: Kustomizer{
+				Profiles: map[string]Profile{
+					"default": {{Base: "base"}, {Dir: "variants"}, {Dir: "envs", Fork: true}, {Dir: "envs"}, {Base: "base"}},
+				},
+			},
+			errs: []string{
+				`profiles.default[3]: dir "envs" is already used by profiles.default[2]`,
+				`profiles.default[4]: base "base" is already used by profiles.default[0]`,
+			},
+		},
+		{
+			name: "same directory in other profiles",
+			cfg: Kustomizer{
+				Profiles: map[string]Profile{
+					"a": {{Base: "base"}, {Dir: "variants"}},
+					"b": {{Base: "base"}, {Dir: "variants"}},
+				},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var errs []string
+			if err := c.cfg.Validate(); err != nil {
+				for _, err := range err.(utilerrors.Aggregate).Errors() {
+					errs = append(errs, err.Error())
+				}
+			}
+			if !reflect.DeepEqual(errs, c.errs) {
+				t.Errorf("expected errors %q, got %q", c.errs, errs)
+			}
+		})
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		errs []string
+	}{
+		{
+			name: "known fields",
+			data: `
+apiVersion: kustomizer.kmodules.xyz/v1alpha1
+kind: Kustomizer
+outputSchema: unified
+generators: true
+profiles:
+  default:
+  - base: base
+  - dir: variants
+    fork: true
+`,
+		},
+		{
+			name: "misspelled field",
+			data: `
+profiles:
+  default:
+  - base: base
+  - Dir: variants
+outputschema: unified
+`,
+			errs: []string{
+				`unknown field "outputschema"`,
+				`unknown field "profiles.default[1].Dir"`,
+			},
+		},
+		{
+			name: "unknown fields of every profile",
+			data: `
+profiles:
+  a:
+  - path: base
+  b:
+  - base: base
+    forked: true
+`,
+			errs: []string{
+				`unknown field "profiles.a[0].path"`,
+				`unknown field "profiles.b[0].forked"`,
+			},
+		},
+		{
+			name: "values of another type",
+			data: `
+profiles:
+  default: base
+crds:
+  path: crds
+`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var raw interface{}
+			if err := yaml2.Unmarshal([]byte(c.data), &raw); err != nil {
+				t.Fatal(err)
+			}
+			var errs []string
+			for _, err := range unknownFields(raw, reflect.TypeOf(Kustomizer{}), "") {
+				errs = append(errs, err.Error())
+			}
+			if !reflect.DeepEqual(errs, c.errs) {
+				t.Errorf("expected errors %q, got %q", c.errs, errs)
+			}
+		})
+	}
+}
+
+func TestLoadKustomizer(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{
+			name: "valid",
+			data: "profiles:\n  default:\n  - base: base\n",
+		},
+		{
+			name: "unknown field",
+			data: "profiles:\n  default:\n  - base: base\n    Fork: true\n",
+			err:  `failed to decode kustomizer.yaml: unknown field "profiles.default[0].Fork"`,
+		},
+		{
+			name: "duplicate field",
+			data: "profiles:\n  default:\n  - base: base\n    base: other\n",
+			err:  "failed to decode kustomizer.yaml",
+		},
+		{
+			name: "invalid variable",
+			data: "profiles:\n  default:\n  - base: base\n    dir: variants\n",
+			err:  `invalid kustomizer.yaml: profiles.default[0]: base "base" and dir "variants" are both set, use one of them`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rootDir := writeTree(t, map[string]string{"kustomizer.yaml": c.data})
+			_, err := LoadKustomizer(filepath.Join(rootDir, "kustomizer.yaml"))
+			var msg string
+			if err != nil {
+				msg = strings.Replace(err.Error(), rootDir+string(filepath.Separator), "", -1)
+			}
+			if !strings.HasPrefix(msg, c.err) || (c.err == "") != (msg == "") {
+				t.Errorf("expected error %q, got %q", c.err, msg)
+			}
+		})
+	}
+}
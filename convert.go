@@ -0,0 +1,96 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"gomodules.xyz/jsonpatch/v3"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// ConvertVersion converts obj to another apiVersion of its group with the
+// conversions registered in the scheme. Kinds that have the same fields in both
+// versions, like Deployments of apps/v1beta2 and apps/v1, are converted by
+// changing their apiVersion. It returns false if obj can not be converted.
+func ConvertVersion(obj *unstructured.Unstructured, apiVersion string) (*unstructured.Unstructured, bool) {
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return nil, false
+	}
+	toGVK := gv.WithKind(obj.GetKind())
+	in, err := scheme.Scheme.New(obj.GroupVersionKind())
+	if err != nil {
+		return nil, false
+	}
+	out, err := scheme.Scheme.New(toGVK)
+	if err != nil {
+		return nil, false
+	}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, in)
+	if err != nil {
+		return nil, false
+	}
+	if err = scheme.Scheme.Convert(in, out, nil); err == nil {
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(out)
+		if err != nil {
+			return nil, false
+		}
+		converted := &unstructured.Unstructured{Object: content}
+		converted.SetGroupVersionKind(toGVK)
+		return converted, true
+	}
+
+	// without a registered conversion, every field of obj must exist in the
+	// type of the other version
+	converted := obj.DeepCopy()
+	converted.SetAPIVersion(apiVersion)
+	data, err := json.Marshal(converted)
+	if err != nil {
+		return nil, false
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(out); err != nil {
+		return nil, false
+	}
+	return converted, true
+}
+
+// generateVersionPatch returns the JSON patch that changes fromObj into toObj,
+// which has a different apiVersion. Strategic merge patches can not change the
+// apiVersion of an object. If fromObj can be converted to the version of
+// toObj, the patch converts it first and then applies the remaining changes.
+func generateVersionPatch(fromObj, toObj *unstructured.Unstructured) ([]jsonpatch.Operation, error) {
+	converted, ok := ConvertVersion(fromObj, toObj.GetAPIVersion())
+	if !ok {
+		return generateJsonPatch(fromObj, toObj)
+	}
+	conversion, err := generateJsonPatch(fromObj, converted)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := generateJsonPatch(converted, toObj)
+	if err != nil {
+		return nil, err
+	}
+	return append(conversion, changes...), nil
+}
@@ -0,0 +1,202 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// decodeObject decodes data, which must hold a single object.
+func decodeObject(t *testing.T, data string) *unstructured.Unstructured {
+	t.Helper()
+	resources := decodeObjects(t, data)
+	if len(resources) != 1 {
+		t.Fatalf("expected a single object, got %d", len(resources))
+	}
+	for _, obj := range resources {
+		return obj
+	}
+	return nil
+}
+
+const convertDeployment = `
+apiVersion: apps/v1beta2
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 2
+  selector:
+    matchLabels:
+      app: web
+  template:
+    metadata:
+      labels:
+        app: web
+    spec:
+      containers:
+      - name: web
+        image: nginx
+`
+
+const convertAutoscaler = `
+apiVersion: autoscaling/v1
+kind: HorizontalPodAutoscaler
+metadata:
+  name: web
+spec:
+  maxReplicas: 4
+  scaleTargetRef:
+    apiVersion: apps/v1
+    kind: Deployment
+    name: web
+  targetCPUUtilizationPercentage: 80
+`
+
+const convertCustomResource = `
+apiVersion: example.com/v1alpha1
+kind: Widget
+metadata:
+  name: web
+spec:
+  size: 2
+`
+
+func TestConvertVersion(t *testing.T) {
+	cases := []struct {
+		name       string
+		obj        string
+		apiVersion string
+		ok         bool
+	}{
+		{
+			name:       "same fields in both versions",
+			obj:        convertDeployment,
+			apiVersion: "apps/v1",
+			ok:         true,
+		},
+		{
+			name:       "unknown version",
+			obj:        convertDeployment,
+			apiVersion: "apps/v9",
+		},
+		{
+			name:       "invalid version",
+			obj:        convertDeployment,
+			apiVersion: "apps/v1/beta",
+		},
+		{
+			name:       "fields missing in the other version",
+			obj:        convertAutoscaler,
+			apiVersion: "autoscaling/v2beta2",
+		},
+		{
+			name:       "custom resource",
+			obj:        convertCustomResource,
+			apiVersion: "example.com/v1",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			obj := decodeObject(t, c.obj)
+			converted, ok := ConvertVersion(obj, c.apiVersion)
+			if ok != c.ok {
+				t.Fatalf("expected %v, got %v", c.ok, ok)
+			}
+			if !ok {
+				return
+			}
+			if converted.GetAPIVersion() != c.apiVersion || converted.GetKind() != obj.GetKind() {
+				t.Errorf("converted to %s %s", converted.GetAPIVersion(), converted.GetKind())
+			}
+			spec, _, _ := unstructured.NestedMap(converted.Object, "spec")
+			expected, _, _ := unstructured.NestedMap(obj.Object, "spec")
+			if !reflect.DeepEqual(spec, expected) {
+				t.Errorf("expected spec %v, got %v", expected, spec)
+			}
+		})
+	}
+}
+
+func TestGenerateVersionPatch(t *testing.T) {
+	cases := []struct {
+		name   string
+		from   string
+		to     string
+		ops    int
+		fields []string
+	}{
+		{
+			name: "converted",
+			from: convertDeployment,
+			to:   strings.Replace(strings.Replace(convertDeployment, "apps/v1beta2", "apps/v1", 1), "replicas: 2", "replicas: 3", 1),
+			// the apiVersion and the replicas, without replacing the whole object
+			ops: 2,
+		},
+		{
+			name: "not converted",
+			from: convertAutoscaler,
+			to: strings.Replace(convertAutoscaler, "autoscaling/v1", "autoscaling/v2beta2", 1) +
+				"  metrics:\n  - type: Resource\n    resource:\n      name: cpu\n      target:\n        type: Utilization\n        averageUtilization: 80\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			from := decodeObject(t, c.from)
+			to := decodeObject(t, c.to)
+			ops, err := generateVersionPatch(from, to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.ops > 0 && len(ops) != c.ops {
+				t.Errorf("expected %d operations, got %v", c.ops, ops)
+			}
+
+			data, err := json.Marshal(ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			patch, err := jsonpatch.DecodePatch(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fromJson, err := json.Marshal(from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			patched, err := patch.Apply(fromJson)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var result unstructured.Unstructured
+			if err := result.UnmarshalJSON(patched); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result.Object, to.Object) {
+				t.Errorf("expected %v, got %v", to.Object, result.Object)
+			}
+		})
+	}
+}
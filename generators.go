@@ -0,0 +1,379 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/kustomize/api/hasher"
+	"sigs.k8s.io/kustomize/api/types"
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	BehaviorMerge   = "merge"
+	BehaviorReplace = "replace"
+)
+
+// Generator describes a configMapGenerator or secretGenerator entry that
+// produces a variant object.
+type Generator struct {
+	// Obj is the object whose data is written to the generator files.
+	Obj       *unstructured.Unstructured
+	Name      string
+	Namespace string
+	Behavior  string
+	// Keys are the data keys written to the generator files.
+	Keys []string
+	// Hash is true if kustomize appends the content hash to the name.
+	Hash bool
+}
+
+// IsGeneratedType returns true if obj is a ConfigMap or Secret that a
+// kustomize generator can produce exactly.
+func IsGeneratedType(obj *unstructured.Unstructured) bool {
+	if obj.GetAPIVersion() != "v1" {
+		return false
+	}
+	var allowed sets.String
+	switch obj.GetKind() {
+	case "ConfigMap":
+		allowed = sets.NewString("apiVersion", "kind", "metadata", "data", "binaryData")
+	case "Secret":
+		allowed = sets.NewString("apiVersion", "kind", "metadata", "data", "type")
+	default:
+		return false
+	}
+	for k := range obj.Object {
+		if !allowed.Has(k) {
+			return false
+		}
+	}
+	metadata, _, _ := unstructured.NestedMap(obj.Object, "metadata")
+	for k := range metadata {
+		if !sets.NewString("name", "namespace", "labels", "annotations").Has(k) {
+			return false
+		}
+	}
+	if len(dataKeys(obj)) == 0 {
+		return false
+	}
+	// kustomize stores valid UTF-8 file content in data
+	binaryData, _, _ := unstructured.NestedStringMap(obj.Object, "binaryData")
+	for _, v := range binaryData {
+		data, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || utf8.Valid(data) {
+			return false
+		}
+	}
+	return true
+}
+
+// PlanGenerators returns the generators that produce the ConfigMaps and
+// Secrets of the variant, keyed by the variant object. hashed holds the base
+// and variant objects kustomize generated with a content hash. Added objects
+// that kustomize generated with a hash can only be produced by a generator,
+// all other objects only get one if all is true.
+func PlanGenerators(tb *TransformedBase, base, target map[ObjKey]*unstructured.Unstructured, hashed map[ObjKey]bool, all bool) map[ObjKey]*Generator {
+	generators := map[ObjKey]*Generator{}
+	for _, objKey := range SortedKeys(target) {
+		obj := target[objKey]
+		if !IsGeneratedType(obj) {
+			continue
+		}
+		if transformed, ok := tb.Resources[objKey]; ok {
+			if !all || reflect.DeepEqual(transformed.Object, obj.Object) {
+				continue
+			}
+			origin := base[tb.Origins[objKey]]
+			g := &Generator{
+				Obj:       obj,
+				Name:      origin.GetName(),
+				Namespace: origin.GetNamespace(),
+				Behavior:  BehaviorReplace,
+				Keys:      dataKeys(obj),
+				Hash:      hashed[tb.Origins[objKey]],
+			}
+			if keys, ok := mergeKeys(transformed, obj); ok && len(keys) > 0 {
+				g.Behavior = BehaviorMerge
+				g.Keys = keys
+			}
+			generators[objKey] = g
+			continue
+		}
+
+		if !all && !hashed[objKey] {
+			continue
+		}
+		addition := tb.Additions[objKey]
+		g := &Generator{
+			Obj:       obj,
+			Name:      addition.GetName(),
+			Namespace: addition.GetNamespace(),
+			Keys:      dataKeys(obj),
+			Hash:      hashed[objKey],
+		}
+		// names that already carry the content hash are generated with
+		// hashing enabled, unless the unhashed name is taken by a base object
+		if name, ok := unhashedName(obj); ok && !g.Hash && !tb.Transforms.renames() {
+			baseKey := objKey
+			baseKey.Name = name
+			if _, ok := tb.Resources[baseKey]; !ok {
+				g.Name = name
+				g.Hash = true
+			}
+		}
+		generators[objKey] = g
+	}
+	return generators
+}
+
+// mergeKeys returns the data keys of to that differ from from, if merging them
+// into from produces to.
+func mergeKeys(from, to *unstructured.Unstructured) ([]string, bool) {
+	if !IsGeneratedType(from) ||
+		!reflect.DeepEqual(from.GetLabels(), to.GetLabels()) ||
+		!reflect.DeepEqual(from.GetAnnotations(), to.GetAnnotations()) {
+		return nil, false
+	}
+	fromType, _, _ := unstructured.NestedString(from.Object, "type")
+	toType, _, _ := unstructured.NestedString(to.Object, "type")
+	if fromType != toType {
+		return nil, false
+	}
+	fromValues := dataValues(from)
+	toValues := dataValues(to)
+	var keys []string
+	for k, v := range fromValues {
+		if _, ok := toValues[k]; !ok {
+			// removed keys can not be merged
+			return nil, false
+		}
+		if toValues[k] != v {
+			keys = append(keys, k)
+		}
+	}
+	for k := range toValues {
+		if _, ok := fromValues[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, true
+}
+
+// unhashedName returns the name of obj without the kustomize content hash
+// suffix, if it has one.
+func unhashedName(obj *unstructured.Unstructured) (string, bool) {
+	name := obj.GetName()
+	i := strings.LastIndex(name, "-")
+	if i <= 0 {
+		return "", false
+	}
+	unhashed := obj.DeepCopy()
+	unhashed.SetName(name[:i])
+	node, err := kyaml.FromMap(unhashed.Object)
+	if err != nil {
+		return "", false
+	}
+	h, err := hasher.HashRNode(node)
+	if err != nil || h != name[i+1:] {
+		return "", false
+	}
+	return name[:i], true
+}
+
+// hashAnnotation marks the objects that kustomize generated with their
+// content hash appended to their name.
+const hashAnnotation = "kustomizer.kmodules.xyz/hashed"
+
+// unhashNames renames the objects of resources that kustomize generated with
+// a content hash to the names they are generated with, and marks them with
+// hashAnnotation. References to them are renamed as well. Patches of overlays
+// address these objects by the names without hash, and kustomize appends the
+// hash of their patched content when building the overlay. hashed maps the
+// objects to their names without hash.
+func unhashNames(resources map[ObjKey]*unstructured.Unstructured, hashed map[ObjKey]string) {
+	if len(hashed) == 0 {
+		return
+	}
+	names := map[string]string{}
+	for objKey, name := range hashed {
+		names[objKey.Name] = name
+	}
+	for _, obj := range resources {
+		renameReferences(obj.Object, names)
+	}
+	for objKey, name := range hashed {
+		obj, ok := resources[objKey]
+		if !ok {
+			continue
+		}
+		delete(resources, objKey)
+		obj.SetName(name)
+		annotations := obj.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[hashAnnotation] = "true"
+		obj.SetAnnotations(annotations)
+		resources[NewObjKey(obj)] = obj
+	}
+}
+
+// renameReferences replaces the string values of v found in names.
+func renameReferences(v interface{}, names map[string]string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if s, ok := child.(string); ok {
+				if name, ok := names[s]; ok {
+					v[k] = name
+				}
+				continue
+			}
+			renameReferences(child, names)
+		}
+	case []interface{}:
+		for i, child := range v {
+			if s, ok := child.(string); ok {
+				if name, ok := names[s]; ok {
+					v[i] = name
+				}
+				continue
+			}
+			renameReferences(child, names)
+		}
+	}
+}
+
+// unhashContentNames renames the ConfigMaps and Secrets of resources whose
+// names end in the hash of their content like unhashNames, as if kustomize
+// had generated them.
+func unhashContentNames(resources map[ObjKey]*unstructured.Unstructured) {
+	hashed := map[ObjKey]string{}
+	for objKey, obj := range resources {
+		if _, ok := obj.GetAnnotations()[hashAnnotation]; ok {
+			continue
+		}
+		if name, ok := unhashedName(obj); ok {
+			hashed[objKey] = name
+		}
+	}
+	unhashNames(resources, hashed)
+}
+
+// takeHashed removes hashAnnotation from the objects of resources and returns
+// the objects that carried it.
+func takeHashed(resources map[ObjKey]*unstructured.Unstructured) map[ObjKey]bool {
+	hashed := map[ObjKey]bool{}
+	for objKey, obj := range resources {
+		annotations := obj.GetAnnotations()
+		if _, ok := annotations[hashAnnotation]; !ok {
+			continue
+		}
+		delete(annotations, hashAnnotation)
+		if len(annotations) == 0 {
+			annotations = nil
+		}
+		obj.SetAnnotations(annotations)
+		hashed[objKey] = true
+	}
+	return hashed
+}
+
+// dataKeys returns the sorted keys of the data and binaryData of obj.
+func dataKeys(obj *unstructured.Unstructured) []string {
+	values := dataValues(obj)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// dataValues returns the decoded file contents stored in obj.
+func dataValues(obj *unstructured.Unstructured) map[string]string {
+	values := map[string]string{}
+	data, _, _ := unstructured.NestedStringMap(obj.Object, "data")
+	if obj.GetKind() == "Secret" {
+		for k, v := range data {
+			decoded, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				decoded = []byte(v)
+			}
+			values[k] = string(decoded)
+		}
+		return values
+	}
+	for k, v := range data {
+		values[k] = v
+	}
+	binaryData, _, _ := unstructured.NestedStringMap(obj.Object, "binaryData")
+	for k, v := range binaryData {
+		decoded, _ := base64.StdEncoding.DecodeString(v)
+		values[k] = string(decoded)
+	}
+	return values
+}
+
+// AddGenerator adds the files of g below dir and the generator to o.
+func (o *Overlay) AddGenerator(dir string, g *Generator) {
+	values := dataValues(g.Obj)
+	args := types.GeneratorArgs{
+		Namespace: g.Namespace,
+		Name:      g.Name,
+		Behavior:  g.Behavior,
+	}
+	for _, k := range g.Keys {
+		path := filepath.ToSlash(filepath.Join(dir, k))
+		o.Files[path] = []byte(values[k])
+		args.FileSources = append(args.FileSources, path)
+	}
+	if g.Behavior != BehaviorMerge && (len(g.Obj.GetLabels()) > 0 || len(g.Obj.GetAnnotations()) > 0) {
+		args.Options = &types.GeneratorOptions{
+			Labels:      g.Obj.GetLabels(),
+			Annotations: g.Obj.GetAnnotations(),
+		}
+	}
+	if !g.Hash {
+		if args.Options == nil {
+			args.Options = &types.GeneratorOptions{}
+		}
+		args.Options.DisableNameSuffixHash = true
+	}
+
+	if g.Obj.GetKind() == "Secret" {
+		secretType, _, _ := unstructured.NestedString(g.Obj.Object, "type")
+		o.Cfg.SecretGenerator = append(o.Cfg.SecretGenerator, types.SecretArgs{
+			GeneratorArgs: args,
+			Type:          secretType,
+		})
+	} else {
+		o.Cfg.ConfigMapGenerator = append(o.Cfg.ConfigMapGenerator, types.ConfigMapArgs{
+			GeneratorArgs: args,
+		})
+	}
+}
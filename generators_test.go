@@ -0,0 +1,223 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/kustomize/api/types"
+)
+
+// generatedConfigMap returns a ConfigMap with the given name and data entries,
+// each entry a "key: value" line.
+func generatedConfigMap(name string, data ...string) string {
+	return "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: " + name + "\ndata:\n  " + strings.Join(data, "\n  ") + "\n"
+}
+
+func TestUnhashedName(t *testing.T) {
+	cases := []struct {
+		name     string
+		obj      string
+		unhashed string
+	}{
+		{
+			name:     "content hash",
+			obj:      generatedConfigMap("cfg-2cfbcb2mhm", `A: "1"`, `B: "3"`),
+			unhashed: "cfg",
+		},
+		{
+			name: "hash of other content",
+			obj:  generatedConfigMap("cfg-2cfbcb2mhm", `A: "1"`, `B: "4"`),
+		},
+		{
+			name: "suffix",
+			obj:  generatedConfigMap("cfg-v2", `A: "1"`),
+		},
+		{
+			name: "no suffix",
+			obj:  generatedConfigMap("cfg", `A: "1"`),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			unhashed, ok := unhashedName(decodeObject(t, c.obj))
+			if ok != (c.unhashed != "") || unhashed != c.unhashed {
+				t.Errorf("expected %q, got %q (%v)", c.unhashed, unhashed, ok)
+			}
+		})
+	}
+}
+
+func TestPlanGenerators(t *testing.T) {
+	base := generatedConfigMap("cfg", `A: "1"`, `B: "2"`)
+	disabled := &types.GeneratorOptions{DisableNameSuffixHash: true}
+	cases := []struct {
+		name string
+		// base defaults to a ConfigMap cfg
+		base   string
+		target string
+		// hashed are the names of the objects kustomize generated with a hash
+		hashed []string
+		all    bool
+		// generators are the expected configMapGenerator entries
+		generators []types.ConfigMapArgs
+	}{
+		{
+			name:   "unchanged",
+			target: base,
+			all:    true,
+		},
+		{
+			name:   "changed key",
+			target: generatedConfigMap("cfg", `A: "1"`, `B: "3"`),
+			all:    true,
+			generators: []types.ConfigMapArgs{{GeneratorArgs: types.GeneratorArgs{
+				Name:          "cfg",
+				Behavior:      BehaviorMerge,
+				KvPairSources: types.KvPairSources{FileSources: []string{"gen/B"}},
+				Options:       disabled,
+			}}},
+		},
+		{
+			name:   "added key",
+			target: generatedConfigMap("cfg", `A: "1"`, `B: "2"`, `C: "3"`),
+			all:    true,
+			generators: []types.ConfigMapArgs{{GeneratorArgs: types.GeneratorArgs{
+				Name:          "cfg",
+				Behavior:      BehaviorMerge,
+				KvPairSources: types.KvPairSources{FileSources: []string{"gen/C"}},
+				Options:       disabled,
+			}}},
+		},
+		{
+			name:   "removed key",
+			target: generatedConfigMap("cfg", `A: "1"`),
+			all:    true,
+			generators: []types.ConfigMapArgs{{GeneratorArgs: types.GeneratorArgs{
+				Name:          "cfg",
+				Behavior:      BehaviorReplace,
+				KvPairSources: types.KvPairSources{FileSources: []string{"gen/A"}},
+				Options:       disabled,
+			}}},
+		},
+		{
+			name:   "changed labels",
+			target: strings.Replace(base, "name: cfg\n", "name: cfg\n  labels:\n    app: web\n", 1),
+			all:    true,
+			generators: []types.ConfigMapArgs{{GeneratorArgs: types.GeneratorArgs{
+				Name:          "cfg",
+				Behavior:      BehaviorReplace,
+				KvPairSources: types.KvPairSources{FileSources: []string{"gen/A", "gen/B"}},
+				Options: &types.GeneratorOptions{
+					Labels:                map[string]string{"app": "web"},
+					DisableNameSuffixHash: true,
+				},
+			}}},
+		},
+		{
+			name:   "hashed base object",
+			target: generatedConfigMap("cfg", `A: "1"`, `B: "3"`),
+			hashed: []string{"cfg"},
+			all:    true,
+			generators: []types.ConfigMapArgs{{GeneratorArgs: types.GeneratorArgs{
+				Name:          "cfg",
+				Behavior:      BehaviorMerge,
+				KvPairSources: types.KvPairSources{FileSources: []string{"gen/B"}},
+			}}},
+		},
+		{
+			name:   "changed base object without generators",
+			target: generatedConfigMap("cfg", `A: "1"`, `B: "3"`),
+		},
+		{
+			name:   "added object",
+			target: base + "---\n" + generatedConfigMap("extra", `X: "1"`),
+			all:    true,
+			generators: []types.ConfigMapArgs{{GeneratorArgs: types.GeneratorArgs{
+				Name:          "extra",
+				KvPairSources: types.KvPairSources{FileSources: []string{"gen/X"}},
+				Options:       disabled,
+			}}},
+		},
+		{
+			name:   "added object without generators",
+			target: base + "---\n" + generatedConfigMap("extra", `X: "1"`),
+		},
+		{
+			name:   "added hashed object without generators",
+			target: base + "---\n" + generatedConfigMap("extra", `X: "1"`),
+			hashed: []string{"extra"},
+			generators: []types.ConfigMapArgs{{GeneratorArgs: types.GeneratorArgs{
+				Name:          "extra",
+				KvPairSources: types.KvPairSources{FileSources: []string{"gen/X"}},
+			}}},
+		},
+		{
+			name:   "added object with a hashed name",
+			base:   generatedConfigMap("app", `A: "1"`),
+			target: generatedConfigMap("app", `A: "1"`) + "---\n" + generatedConfigMap("cfg-2cfbcb2mhm", `A: "1"`, `B: "3"`),
+			all:    true,
+			generators: []types.ConfigMapArgs{{GeneratorArgs: types.GeneratorArgs{
+				Name:          "cfg",
+				KvPairSources: types.KvPairSources{FileSources: []string{"gen/A", "gen/B"}},
+			}}},
+		},
+		{
+			name:   "added object with a hashed name taken by the base",
+			target: base + "---\n" + generatedConfigMap("cfg-2cfbcb2mhm", `A: "1"`, `B: "3"`),
+			all:    true,
+			generators: []types.ConfigMapArgs{{GeneratorArgs: types.GeneratorArgs{
+				Name:          "cfg-2cfbcb2mhm",
+				KvPairSources: types.KvPairSources{FileSources: []string{"gen/A", "gen/B"}},
+				Options:       disabled,
+			}}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if c.base == "" {
+				c.base = base
+			}
+			baseResources := decodeObjects(t, c.base)
+			target := decodeObjects(t, c.target)
+			hashed := map[ObjKey]bool{}
+			for _, name := range c.hashed {
+				for objKey := range target {
+					if objKey.Name == name {
+						hashed[objKey] = true
+					}
+				}
+			}
+			tb := NewTransformedBase(baseResources, target)
+
+			generators := PlanGenerators(tb, baseResources, target, hashed, c.all)
+			o := &Overlay{Files: map[string][]byte{}}
+			for _, objKey := range SortedKeys(target) {
+				if g, ok := generators[objKey]; ok {
+					o.AddGenerator("gen", g)
+				}
+			}
+			if !reflect.DeepEqual(o.Cfg.ConfigMapGenerator, c.generators) {
+				t.Errorf("expected %+v, got %+v", c.generators, o.Cfg.ConfigMapGenerator)
+			}
+		})
+	}
+}
@@ -3,16 +3,18 @@ module kmodules.xyz/kustomizer
 go 1.15
 
 require (
+	github.com/evanphx/json-patch v4.11.0+incompatible
 	github.com/google/go-cmp v0.5.6 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
 	github.com/spf13/cobra v1.1.3
 	gomodules.xyz/go-sh v0.1.0
 	gomodules.xyz/jsonpatch/v3 v3.0.1
-	gomodules.xyz/x v0.0.8
 	k8s.io/apimachinery v0.21.1
 	k8s.io/client-go v0.21.1
+	k8s.io/kube-openapi v0.0.0-20210305001622-591a79e4bda7
 	kmodules.xyz/client-go v0.0.0-20211013093146-1fbfd52e78c9
 	sigs.k8s.io/kustomize/api v0.8.5
+	sigs.k8s.io/kustomize/kyaml v0.10.15
 	sigs.k8s.io/yaml v1.2.0
 )
 
@@ -0,0 +1,162 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/kustomize/api/types"
+)
+
+// inferImages returns the images transformers that change the container
+// images of the base objects into the images used by the variant. Kustomize
+// rewrites every image with a matching name in any containers or
+// initContainers list, so an image is only lifted if all its occurrences
+// change the same way and the variant has no other image of that name.
+func inferImages(base, target map[ObjKey]*unstructured.Unstructured) []types.Image {
+	changes := map[string]string{}
+	changed := sets.NewString()
+	inconsistent := sets.NewString()
+	var occurrences [][2]string
+	for _, objKey := range SortedKeys(base) {
+		targetObj, ok := target[objKey]
+		if !ok {
+			continue
+		}
+		targetImages := containerImages(targetObj.Object)
+		for path, from := range containerImages(base[objKey].Object) {
+			to, ok := targetImages[path]
+			if !ok {
+				continue
+			}
+			name, _, _ := splitImage(from)
+			if prev, ok := changes[name]; ok && prev != to {
+				inconsistent.Insert(name)
+			}
+			changes[name] = to
+			if from != to {
+				changed.Insert(name)
+			}
+			occurrences = append(occurrences, [2]string{from, to})
+		}
+	}
+
+	var images []types.Image
+	for _, name := range changed.Difference(inconsistent).List() {
+		newName, tag, digest := splitImage(changes[name])
+		image := types.Image{Name: name}
+		if newName != name {
+			image.NewName = newName
+		}
+		if digest != "" {
+			image.Digest = digest
+		} else {
+			image.NewTag = tag
+		}
+		if imageConsistent(image, occurrences, target) {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+// imageConsistent returns true if the transformer turns every base occurrence
+// of the image into its variant image and leaves the images of the variant
+// unchanged.
+func imageConsistent(image types.Image, occurrences [][2]string, target map[ObjKey]*unstructured.Unstructured) bool {
+	for _, o := range occurrences {
+		if name, _, _ := splitImage(o[0]); name == image.Name && applyImage(image, o[0]) != o[1] {
+			return false
+		}
+	}
+	for _, obj := range target {
+		for _, img := range containerImages(obj.Object) {
+			if applyImage(image, img) != img {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// applyImage returns img as rewritten by the kustomize images transformer.
+func applyImage(image types.Image, img string) string {
+	name, tag, digest := splitImage(img)
+	if name != image.Name {
+		return img
+	}
+	if image.NewName != "" {
+		name = image.NewName
+	}
+	switch {
+	case image.Digest != "":
+		return name + "@" + image.Digest
+	case image.NewTag != "":
+		return name + ":" + image.NewTag
+	case digest != "":
+		return name + "@" + digest
+	case tag != "":
+		return name + ":" + tag
+	}
+	return name
+}
+
+// splitImage splits a container image into its name, tag and digest.
+func splitImage(img string) (string, string, string) {
+	if i := strings.Index(img, "@"); i >= 0 {
+		return img[:i], "", img[i+1:]
+	}
+	if i := strings.LastIndex(img, ":"); i > strings.LastIndex(img, "/") {
+		return img[:i], img[i+1:], ""
+	}
+	return img, "", ""
+}
+
+// containerImages returns the images of the containers found in any
+// containers or initContainers list of obj, keyed by the path of the list and
+// the container name.
+func containerImages(obj map[string]interface{}) map[string]string {
+	images := map[string]string{}
+	var walk func(v interface{}, path string)
+	walk = func(v interface{}, path string) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, child := range v {
+				if containers, ok := child.([]interface{}); ok && (k == "containers" || k == "initContainers") {
+					for _, c := range containers {
+						if c, ok := c.(map[string]interface{}); ok {
+							name, _ := c["name"].(string)
+							if img, ok := c["image"].(string); ok {
+								images[path+"/"+k+"/"+name] = img
+							}
+						}
+					}
+				}
+				walk(child, path+"/"+k)
+			}
+		case []interface{}:
+			for i, item := range v {
+				walk(item, path+"/"+strconv.Itoa(i))
+			}
+		}
+	}
+	walk(obj, "")
+	return images
+}
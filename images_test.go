@@ -0,0 +1,120 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/kustomize/api/types"
+)
+
+// imagesDeployment returns a Deployment with a container and an init container
+// using the given images.
+func imagesDeployment(name, image, initImage string) string {
+	return `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: ` + name + `
+spec:
+  template:
+    spec:
+      initContainers:
+      - name: init
+        image: ` + initImage + `
+      containers:
+      - name: main
+        image: ` + image + `
+`
+}
+
+func TestInferImages(t *testing.T) {
+	base := imagesDeployment("web", "nginx:1.19", "busybox") + "---" + imagesDeployment("api", "nginx:1.19", "busybox")
+	cases := []struct {
+		name   string
+		target string
+		images []types.Image
+	}{
+		{
+			name:   "unchanged",
+			target: base,
+		},
+		{
+			name:   "new tag",
+			target: strings.Replace(base, "nginx:1.19", "nginx:1.21", -1),
+			images: []types.Image{{Name: "nginx", NewTag: "1.21"}},
+		},
+		{
+			name:   "new name",
+			target: strings.Replace(base, "nginx:1.19", "registry.local:5000/nginx:1.19", -1),
+			images: []types.Image{{Name: "nginx", NewName: "registry.local:5000/nginx", NewTag: "1.19"}},
+		},
+		{
+			name:   "digest",
+			target: strings.Replace(base, "nginx:1.19", "nginx@sha256:abc", -1),
+			images: []types.Image{{Name: "nginx", Digest: "sha256:abc"}},
+		},
+		{
+			name:   "init container",
+			target: strings.Replace(base, "busybox", "busybox:1.33", -1),
+			images: []types.Image{{Name: "busybox", NewTag: "1.33"}},
+		},
+		{
+			name:   "changed in one of the objects",
+			target: strings.Replace(base, "nginx:1.19", "nginx:1.21", 1),
+		},
+		{
+			name:   "changed differently",
+			target: strings.Replace(strings.Replace(base, "nginx:1.19", "nginx:1.21", 1), "nginx:1.19", "nginx:1.22", 1),
+		},
+		{
+			name: "added object with the base image",
+			target: strings.Replace(base, "nginx:1.19", "nginx:1.21", -1) + "---" +
+				imagesDeployment("extra", "nginx:1.19", "busybox"),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			images := inferImages(decodeObjects(t, base), decodeObjects(t, c.target))
+			if !reflect.DeepEqual(images, c.images) {
+				t.Errorf("got %+v, want %+v", images, c.images)
+			}
+		})
+	}
+}
+
+func TestSplitImage(t *testing.T) {
+	cases := []struct {
+		image, name, tag, digest string
+	}{
+		{image: "nginx", name: "nginx"},
+		{image: "nginx:1.19", name: "nginx", tag: "1.19"},
+		{image: "nginx@sha256:abc", name: "nginx", digest: "sha256:abc"},
+		{image: "registry.local:5000/nginx", name: "registry.local:5000/nginx"},
+		{image: "registry.local:5000/nginx:1.19", name: "registry.local:5000/nginx", tag: "1.19"},
+	}
+
+	for _, c := range cases {
+		name, tag, digest := splitImage(c.image)
+		if name != c.name || tag != c.tag || digest != c.digest {
+			t.Errorf("%s: got %q, %q, %q, want %q, %q, %q", c.image, name, tag, digest, c.name, c.tag, c.digest)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// SetJobs sets the number of overlays planned concurrently.
+func (p *Processor) SetJobs(n int) {
+	if n < 1 {
+		n = 1
+	}
+	p.jobs = make(chan struct{}, n)
+}
+
+// acquire blocks until one of the jobs is free. Only the work of planning an
+// overlay holds a job, so that waiting for the variants of a subtree never
+// blocks the workers processing them.
+func (p *Processor) acquire() {
+	p.jobs <- struct{}{}
+}
+
+func (p *Processor) release() {
+	<-p.jobs
+}
+
+// forEach calls fn for every index below n, concurrently if more than one
+// job is allowed. It returns the errors of all calls, in the order of their
+// index. With a single job the calls are made in order and stop at the first
+// error.
+func (p *Processor) forEach(n int, fn func(i int) error) error {
+	if cap(p.jobs) <= 1 {
+		for i := 0; i < n; i++ {
+			if err := fn(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fn(i)
+		}(i)
+	}
+	wg.Wait()
+	return utilerrors.NewAggregate(errs)
+}
@@ -0,0 +1,121 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/kustomize/api/filesys"
+)
+
+const benchBase = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  selector:
+    matchLabels:
+      app: web
+  template:
+    metadata:
+      labels:
+        app: web
+    spec:
+      containers:
+      - name: web
+        image: nginx:1.19
+        env:
+        - name: MODE
+          value: base
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cfg
+data:
+  A: "0"
+`
+
+// benchTree writes a base with variants that change an env var, the image
+// and the data of a ConfigMap.
+func benchTree(tb testing.TB, variants int) string {
+	tb.Helper()
+	rootDir := tb.TempDir()
+	files := map[string]string{
+		"base/kustomization.yaml": "resources:\n- all.yaml\n",
+		"base/all.yaml":           benchBase,
+	}
+	for i := 0; i < variants; i++ {
+		data := strings.Replace(benchBase, "value: base", fmt.Sprintf("value: m%d", i%7), 1)
+		data = strings.Replace(data, "nginx:1.19", fmt.Sprintf("nginx:1.%d", 19+i%5), 1)
+		data = strings.Replace(data, `A: "0"`, fmt.Sprintf(`A: "%d"`, i), 1)
+		files[fmt.Sprintf("variants/v%d/kustomization.yaml", i)] = verifyKustomization
+		files[fmt.Sprintf("variants/v%d/all.yaml", i)] = data
+	}
+	for name, content := range files {
+		path := filepath.Join(rootDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0o644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return rootDir
+}
+
+func TestProcessDirJobs(t *testing.T) {
+	rootDir := benchTree(t, 8)
+	var trees []map[string][]byte
+	for _, jobs := range []int{1, 4} {
+		p := NewProcessor(filesys.MakeFsInMemory())
+		p.SetJobs(jobs)
+		if err := p.ProcessDir(rootDir, "", "/out", []Variable{{Base: "base"}, {Dir: "variants"}}); err != nil {
+			t.Fatal(err)
+		}
+		files, err := readTree(p.fs, "/out")
+		if err != nil {
+			t.Fatal(err)
+		}
+		trees = append(trees, files)
+	}
+	if !reflect.DeepEqual(trees[0], trees[1]) {
+		t.Error("the output of concurrent jobs differs from the output of a single job")
+	}
+}
+
+func BenchmarkProcessDir(b *testing.B) {
+	rootDir := benchTree(b, 40)
+	for _, jobs := range []int{1, 4} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				p := NewProcessor(filesys.MakeFsInMemory())
+				p.SetJobs(jobs)
+				if err := p.ProcessDir(rootDir, "", "/out", []Variable{{Base: "base"}, {Dir: "variants"}}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
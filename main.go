@@ -25,22 +25,29 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
+	"sync"
+	"text/template"
 
 	"github.com/spf13/cobra"
 	"gomodules.xyz/jsonpatch/v3"
-	ioutil2 "gomodules.xyz/x/ioutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/strategicpatch"
 	"k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/kustomize/api/filesys"
+	"sigs.k8s.io/kustomize/api/filters/patchstrategicmerge"
 	"sigs.k8s.io/kustomize/api/resid"
 	"sigs.k8s.io/kustomize/api/types"
+	kyaml "sigs.k8s.io/kustomize/kyaml/yaml"
 	yaml2 "sigs.k8s.io/yaml"
 )
 
@@ -53,13 +60,63 @@ type Variable struct {
 type Profile []Variable
 
 type Kustomizer struct {
-	Profiles map[string]Profile `json:"profiles"`
+	metav1.TypeMeta `json:",inline"`
+
+	Profiles     map[string]Profile `json:"profiles"`
+	OutputSchema OutputSchema       `json:"outputSchema,omitempty"`
+	// CRDs lists files or directories with CustomResourceDefinitions, used
+	// to generate strategic merge patches for custom resources.
+	CRDs []string `json:"crds,omitempty"`
+	// OpenAPI lists files or directories with OpenAPI v2 documents, used
+	// to generate strategic merge patches for custom resources.
+	OpenAPI []string `json:"openapi,omitempty"`
+	// Generators writes ConfigMaps and Secrets as configMapGenerator and
+	// secretGenerator entries backed by files.
+	Generators bool `json:"generators,omitempty"`
+	// CollapseNoop makes variants that do not change their base refer to the
+	// base directly instead of generating an empty overlay.
+	CollapseNoop bool `json:"collapseNoop,omitempty"`
+	// FileNameTemplate is a Go template for the names of generated files,
+	// without the .yaml extension. See FileNameData for its fields.
+	FileNameTemplate string `json:"fileNameTemplate,omitempty"`
+}
+
+// OutputSchema selects the kustomization fields used by generated overlays.
+type OutputSchema string
+
+const (
+	// OutputSchemaLegacy uses the bases, patchesStrategicMerge and
+	// patchesJson6902 fields.
+	OutputSchemaLegacy OutputSchema = "legacy"
+	// OutputSchemaUnified lists bases under resources and writes every patch
+	// to the patches field, as expected by current kustomize releases.
+	OutputSchemaUnified OutputSchema = "unified"
+)
+
+func (s OutputSchema) Validate() error {
+	switch s {
+	case "", OutputSchemaLegacy, OutputSchemaUnified:
+		return nil
+	}
+	return fmt.Errorf("unknown output schema %q, must be one of %s or %s", s, OutputSchemaLegacy, OutputSchemaUnified)
 }
 
 func main() {
+	var outputSchema string
+	var verify bool
+	var check bool
+	var generators bool
+	var collapseNoop bool
+	var profiles []string
+	var listProfiles bool
+	var jobs int
 	rootCmd := &cobra.Command{
 		Use:   "kustomizer input_dir output_dir",
 		Short: "Generate json patch",
+		// failed verifications and out of date output directories are
+		// expected outcomes, reported without usage
+		SilenceUsage:  true,
+		SilenceErrors: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if len(args) != 2 {
 				return fmt.Errorf("usage: kustomizer input_dir output_dir")
@@ -68,44 +125,299 @@ func main() {
 			rootDir := args[0]
 			dstDir := args[1]
 
-			err := os.MkdirAll(dstDir, 0o755)
+			cfg, err := LoadKustomizer(filepath.Join(rootDir, "kustomizer.yaml"))
 			if err != nil {
 				return err
 			}
-			data, err := os.ReadFile(filepath.Join(rootDir, "kustomizer.yaml"))
+			names, err := cfg.ProfileNames(profiles)
 			if err != nil {
 				return err
 			}
-			var cfg Kustomizer
-			err = yaml2.Unmarshal(data, &cfg)
+			names, err = cfg.OrderProfiles(rootDir, names)
 			if err != nil {
 				return err
 			}
+			if listProfiles {
+				for _, name := range names {
+					fmt.Println(name)
+				}
+				return nil
+			}
+			if outputSchema != "" {
+				cfg.OutputSchema = OutputSchema(outputSchema)
+				err = cfg.OutputSchema.Validate()
+				if err != nil {
+					return err
+				}
+			}
+
+			fs := filesys.MakeFsOnDisk()
+			if check {
+				// generate in memory and compare with the output directory afterwards
+				fs = filesys.MakeFsInMemory()
+				dstDir, err = filepath.Abs(dstDir)
+				if err != nil {
+					return err
+				}
+			} else {
+				err = fs.MkdirAll(dstDir)
+				if err != nil {
+					return err
+				}
+			}
 
-			for profile, v := range cfg.Profiles {
+			p := NewProcessor(fs)
+			p.OutputSchema = cfg.OutputSchema
+			p.Generators = cfg.Generators || generators
+			p.CollapseNoop = cfg.CollapseNoop || collapseNoop
+			p.SetJobs(jobs)
+			if cfg.FileNameTemplate != "" {
+				p.FileNameTemplate, err = ParseFileNameTemplate(cfg.FileNameTemplate)
+				if err != nil {
+					return err
+				}
+			}
+			err = p.Schemas.Load(rootDir, cfg.CRDs, cfg.OpenAPI)
+			if err != nil {
+				return err
+			}
+			for _, profile := range names {
 				fmt.Println("processing profile", profile)
-				err = ProcessDir(rootDir, "", dstDir, v)
+				err = p.AddCRDs(rootDir, cfg.Profiles[profile])
+				if err != nil {
+					return err
+				}
+				err = p.ProcessBases(rootDir, dstDir, cfg.Profiles[profile])
+				if err != nil {
+					return err
+				}
+				err = p.ProcessDir(rootDir, "", dstDir, cfg.Profiles[profile])
 				if err != nil {
 					return err
 				}
 			}
+			if verify {
+				err = p.Verify()
+				if err != nil {
+					return err
+				}
+			}
+			if check {
+				var skip *OutputDirs
+				if len(names) < len(cfg.Profiles) {
+					all, err := cfg.ProfileNames(nil)
+					if err != nil {
+						return err
+					}
+					skip, err = cfg.OutputDirs(rootDir, sets.NewString(all...).Difference(sets.NewString(names...)).List())
+					if err != nil {
+						return err
+					}
+				}
+				return p.Check(dstDir, skip)
+			}
 			return nil
 		},
 	}
+	rootCmd.Flags().StringVar(&outputSchema, "output-schema", "", "Kustomization fields used by generated overlays, one of legacy or unified (overrides kustomizer.yaml)")
+	rootCmd.Flags().BoolVar(&verify, "verify", false, "Build every generated overlay and check that it reproduces its input variant")
+	rootCmd.Flags().BoolVar(&generators, "generators", false, "Write ConfigMaps and Secrets as configMapGenerator and secretGenerator entries")
+	rootCmd.Flags().BoolVar(&collapseNoop, "collapse-noop", false, "Refer to the base directly instead of generating an overlay for variants that do not change it")
+	rootCmd.Flags().BoolVar(&check, "check", false, "Check that the output directory is up to date without writing to it")
+	rootCmd.Flags().StringArrayVar(&profiles, "profile", nil, "Process only the profiles matching this glob pattern, can be repeated")
+	rootCmd.Flags().BoolVar(&listProfiles, "list-profiles", false, "List the profiles that would be processed and exit")
+	rootCmd.Flags().IntVar(&jobs, "jobs", 1, "Number of variants processed concurrently")
 	rootCmd.Flags().AddGoFlagSet(flag.CommandLine)
 	utilruntime.Must(flag.CommandLine.Parse([]string{}))
 
-	utilruntime.Must(rootCmd.Execute())
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
 }
 
+const openAPIFilename = "openapi.json"
+
+// ObjKey identifies an object by group, kind, namespace and name. The version
+// is left out, so that an object matches its base after the variant moved it
+// to another version of its group.
 type ObjKey struct {
-	APIVersion string
-	Kind       string
-	Name       string
-	Namespace  string
+	Group     string
+	Kind      string
+	Name      string
+	Namespace string
+}
+
+func NewObjKey(obj *unstructured.Unstructured) ObjKey {
+	return ObjKey{
+		Group:     obj.GroupVersionKind().Group,
+		Kind:      obj.GetKind(),
+		Name:      obj.GetName(),
+		Namespace: obj.GetNamespace(),
+	}
+}
+
+func (k ObjKey) String() string {
+	gk := schema.GroupKind{Group: k.Group, Kind: k.Kind}
+	if k.Namespace == "" {
+		return fmt.Sprintf("%s %s", gk, k.Name)
+	}
+	return fmt.Sprintf("%s %s/%s", gk, k.Namespace, k.Name)
+}
+
+// Less orders keys by group, kind, namespace and name.
+func (k ObjKey) Less(other ObjKey) bool {
+	if k.Group != other.Group {
+		return k.Group < other.Group
+	}
+	if k.Kind != other.Kind {
+		return k.Kind < other.Kind
+	}
+	if k.Namespace != other.Namespace {
+		return k.Namespace < other.Namespace
+	}
+	return k.Name < other.Name
+}
+
+// SortedKeys returns the keys of the given resource maps without duplicates,
+// in the order defined by ObjKey.Less.
+func SortedKeys(resources ...map[ObjKey]*unstructured.Unstructured) []ObjKey {
+	seen := map[ObjKey]bool{}
+	var keys []ObjKey
+	for _, m := range resources {
+		for objKey := range m {
+			if !seen[objKey] {
+				seen[objKey] = true
+				keys = append(keys, objKey)
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Less(keys[j])
+	})
+	return keys
+}
+
+// Processor generates kustomize bases and overlays from the variables of
+// one or more profiles.
+type Processor struct {
+	OutputSchema OutputSchema
+	Generators   bool
+	CollapseNoop bool
+	// FileNameTemplate overrides the default names of generated files.
+	FileNameTemplate *template.Template
+	Schemas          *Schemas
+
+	// fs receives the generated files.
+	fs filesys.FileSystem
+	// jobs limits the number of overlays planned concurrently.
+	jobs chan struct{}
+	// cache holds the parsed input files.
+	cache *Cache
+
+	// mu guards fs and the maps below.
+	mu sync.Mutex
+
+	// generated maps every processed input directory to the directory its
+	// kustomization was generated in.
+	generated map[string]string
+	// sources maps every generated directory to the input directory it was
+	// generated from.
+	sources map[string]source
+	// shared holds the directories of the intermediate bases and components
+	// extracted from sibling overlays. Forks extract them from more than one
+	// set of siblings below the same directory.
+	shared sets.String
+}
+
+type source struct {
+	dir string
+	// copied is true when the input directory was copied as is.
+	copied bool
+	// exact is true when building the generated kustomization is expected to
+	// produce the resources of the input directory. This is not the case when
+	// the overlay of a variant is applied to a base other than its own, as
+	// done for forks and the sibling directories of dir variables.
+	exact bool
+}
+
+func NewProcessor(fs filesys.FileSystem) *Processor {
+	return &Processor{
+		Schemas:   NewSchemas(),
+		fs:        fs,
+		jobs:      make(chan struct{}, 1),
+		cache:     NewCache(),
+		generated: map[string]string{},
+		sources:   map[string]source{},
+		shared:    sets.NewString(),
+	}
+}
+
+// AddCRDs indexes the CustomResourceDefinitions found in the input directories
+// of the variables before any of them is processed, so that the generated
+// patches do not depend on the order the variants are processed in.
+func (p *Processor) AddCRDs(rootDir string, vars []Variable) error {
+	srcDirs, err := sourceDirs(rootDir, vars)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, srcDir := range srcDirs {
+		cfg, err := p.cache.LoadKustomization(filepath.Join(srcDir, "kustomization.yaml"))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		resources, err := p.cache.LoadObjects(srcDir, cfg)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, objKey := range SortedKeys(resources) {
+			if obj := resources[objKey]; IsCRD(obj) {
+				err = p.Schemas.AddCRD(obj)
+				if err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// record registers dstDir as the directory generated for srcDir. src is nil if
+// no kustomization is written to dstDir for srcDir.
+func (p *Processor) record(srcDir, dstDir string, src *source) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.generated[srcDir] = dstDir
+	if src != nil {
+		p.sources[dstDir] = *src
+	}
 }
 
-func ProcessDir(rootDir, dstBase, dstDir string, vars []Variable) error {
+// lookup returns the directory generated for srcDir and whether building it
+// reproduces srcDir exactly.
+func (p *Processor) lookup(srcDir string) (string, bool, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	dstDir, ok := p.generated[srcDir]
+	return dstDir, p.sources[dstDir].exact, ok
+}
+
+// claim reserves dir for an overlay extracted from sibling overlays. It
+// returns false if dir was already claimed.
+func (p *Processor) claim(dir string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.shared.Has(dir) {
+		return false
+	}
+	p.shared.Insert(dir)
+	return true
+}
+
+func (p *Processor) ProcessDir(rootDir, dstBase, dstDir string, vars []Variable) error {
 	if len(vars) == 0 {
 		return nil
 	}
@@ -114,16 +426,22 @@ func ProcessDir(rootDir, dstBase, dstDir string, vars []Variable) error {
 		if len(vars) > 1 && filepath.Base(nextDstDir) != "base" {
 			nextDstDir = filepath.Join(nextDstDir, "base")
 		}
-		err := ProcessBaseDir(rootDir, vars[0].Base, dstBase, nextDstDir)
+		p.acquire()
+		o, err := p.PlanOverlay(rootDir, vars[0].Base, dstBase, nextDstDir)
+		p.release()
+		if err != nil {
+			return err
+		}
+		err = p.WriteOverlay(o)
 		if err != nil {
 			return err
 		}
-		err = ProcessDir(rootDir, nextDstDir, filepath.Dir(nextDstDir), vars[1:])
+		err = p.ProcessDir(rootDir, o.BaseDir(), filepath.Dir(nextDstDir), vars[1:])
 		if err != nil {
 			return err
 		}
 		if len(vars) > 2 && vars[1].Fork {
-			err = ProcessDir(rootDir, nextDstDir, filepath.Dir(nextDstDir), vars[2:])
+			err = p.ProcessDir(rootDir, o.BaseDir(), filepath.Dir(nextDstDir), vars[2:])
 			if err != nil {
 				return err
 			}
@@ -134,362 +452,532 @@ func ProcessDir(rootDir, dstBase, dstDir string, vars []Variable) error {
 		if err != nil {
 			return err
 		}
+		var names []string
 		for _, dirVar := range dirVars {
 			if dirVar.IsDir() {
-				nextDstDir := filepath.Join(dstDir, dirVar.Name())
-				if len(vars) > 1 {
-					nextDstDir = filepath.Join(nextDstDir, "base")
-				}
-				err := ProcessBaseDir(filepath.Join(rootDir, vars[0].Dir), dirVar.Name(), dstBase, nextDstDir)
-				if err != nil {
-					return err
-				}
-				err = ProcessDir(rootDir, nextDstDir, filepath.Dir(nextDstDir), vars[1:])
-				if err != nil {
-					return err
-				}
-				if len(vars) > 2 && vars[1].Fork {
-					err = ProcessDir(rootDir, nextDstDir, filepath.Dir(nextDstDir), vars[2:])
-					if err != nil {
-						return err
-					}
-				}
+				names = append(names, dirVar.Name())
+			}
+		}
+		// the overlays of all siblings are planned first to move the patches
+		// they share into an intermediate base and components
+		overlays := make([]*Overlay, len(names))
+		err = p.forEach(len(names), func(i int) error {
+			nextDstDir := filepath.Join(dstDir, names[i])
+			if len(vars) > 1 {
+				nextDstDir = filepath.Join(nextDstDir, "base")
 			}
+			p.acquire()
+			defer p.release()
+			o, err := p.PlanOverlay(filepath.Join(rootDir, vars[0].Dir), names[i], dstBase, nextDstDir)
+			overlays[i] = o
+			return err
+		})
+		if err != nil {
+			return err
 		}
+		siblings := map[string]*Overlay{}
+		for i, name := range names {
+			siblings[name] = overlays[i]
+		}
+		if common := p.HoistCommonPatches(dstDir, siblings); common != nil {
+			err = p.WriteOverlay(common)
+			if err != nil {
+				return err
+			}
+		}
+		for _, c := range p.ExtractComponents(dstDir, siblings) {
+			err = p.WriteOverlay(c)
+			if err != nil {
+				return err
+			}
+		}
+		for _, name := range names {
+			err = p.WriteOverlay(siblings[name])
+			if err != nil {
+				return err
+			}
+		}
+		// the subtrees of the siblings are independent of each other
+		return p.forEach(len(names), func(i int) error {
+			o := overlays[i]
+			err := p.ProcessDir(rootDir, o.BaseDir(), filepath.Dir(o.Dir), vars[1:])
+			if err != nil {
+				return err
+			}
+			if len(vars) > 2 && vars[1].Fork {
+				return p.ProcessDir(rootDir, o.BaseDir(), filepath.Dir(o.Dir), vars[2:])
+			}
+			return nil
+		})
 	}
 	return nil
 }
 
-func ProcessBaseDir(rootDir string, xBase string, dstBase, dstDir string) error {
+// PlanOverlay computes the kustomization generated in dstDir for the input
+// directory xBase of rootDir, without writing it. dstBase is the generated
+// directory of its first base.
+func (p *Processor) PlanOverlay(rootDir string, xBase string, dstBase, dstDir string) (*Overlay, error) {
 	var srcCfg *types.Kustomization
-	srcKustomization := filepath.Join(rootDir, xBase, "kustomization.yaml")
-	srcCfg, err := LoadKustomization(srcKustomization)
+	srcDir := filepath.Join(rootDir, xBase)
+	srcKustomization := filepath.Join(srcDir, "kustomization.yaml")
+	srcCfg, err := p.cache.LoadKustomization(srcKustomization)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if len(srcCfg.Bases) == 0 {
-		return ioutil2.CopyDir(dstDir, filepath.Join(rootDir, xBase), ioutil2.IgnoreDestination())
-	} else if len(srcCfg.Bases) > 1 {
-		return fmt.Errorf("%s has more than one bases", srcKustomization)
+		if !hasExternalDir(srcDir, srcCfg.Resources) {
+			p.record(srcDir, dstDir, &source{dir: srcDir, copied: true, exact: true})
+			return &Overlay{SrcDir: srcDir, Dir: dstDir, Copied: true}, nil
+		}
+		// a copy would refer to directories outside of the output tree, so
+		// the rendered objects are written instead
+		return p.planRendered(srcDir, dstDir)
 	}
-	targetResources := map[ObjKey]*unstructured.Unstructured{}
 
-	for _, res := range srcCfg.Resources {
-		data, err := os.ReadFile(filepath.Join(rootDir, xBase, res))
-		if err != nil {
-			return err
-		}
-		reader := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 2048)
-		for {
-			var obj unstructured.Unstructured
-			err := reader.Decode(&obj)
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				return err
-			}
-			if obj.IsList() {
-				err := obj.EachListItem(func(item runtime.Object) error {
-					castItem := item.(*unstructured.Unstructured)
-					targetResources[ObjKey{
-						APIVersion: castItem.GetAPIVersion(),
-						Kind:       castItem.GetKind(),
-						Name:       castItem.GetName(),
-						Namespace:  castItem.GetNamespace(),
-					}] = castItem
-					return nil
-				})
-				if err != nil {
-					return err
+	targetResources, err := p.cache.LoadObjects(srcDir, srcCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// The first base is the one generated by the previous variable of the
+	// profile. Any other base is generated by another profile or on demand
+	// before the profile, see ProcessBases.
+	dstBases := make([]string, len(srcCfg.Bases))
+	exact := true
+	for i, base := range srcCfg.Bases {
+		baseDir := filepath.Join(srcDir, base)
+		if i == 0 && dstBase != "" {
+			dstBases[i] = dstBase
+		} else {
+			generated, _, ok := p.lookup(baseDir)
+			if !ok {
+				if i == 0 {
+					// kept for compatibility: the overlay is generated without its base
+					exact = false
+					continue
 				}
-			} else {
-				targetResources[ObjKey{
-					APIVersion: obj.GetAPIVersion(),
-					Kind:       obj.GetKind(),
-					Name:       obj.GetName(),
-					Namespace:  obj.GetNamespace(),
-				}] = &obj
+				return nil, fmt.Errorf("base %s of %s has not been generated, it belongs to the same profile", base, srcKustomization)
 			}
+			dstBases[i] = generated
+		}
+		if generated, baseExact, _ := p.lookup(baseDir); generated != dstBases[i] || !baseExact {
+			exact = false
 		}
 	}
 
-	baseDir := filepath.Join(rootDir, xBase, srcCfg.Bases[0])
-	baseKustomization := filepath.Join(baseDir, "kustomization.yaml")
-	baseCfg, err := LoadKustomization(baseKustomization)
-	if err != nil {
-		return err
-	}
 	baseResources := map[ObjKey]*unstructured.Unstructured{}
-	for _, res := range baseCfg.Resources {
-		data, err := os.ReadFile(filepath.Join(baseDir, res))
+	// baseOrigins records which base each of the baseResources came from.
+	baseOrigins := map[ObjKey]string{}
+	for _, base := range srcCfg.Bases {
+		baseDir := filepath.Join(srcDir, base)
+		baseKustomization := filepath.Join(baseDir, "kustomization.yaml")
+		baseCfg, err := p.cache.LoadKustomization(baseKustomization)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		reader := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 2048)
-		for {
-			var obj unstructured.Unstructured
-			err := reader.Decode(&obj)
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				return err
+		resources, err := p.cache.LoadObjects(baseDir, baseCfg)
+		if err != nil {
+			return nil, err
+		}
+		for objKey, obj := range resources {
+			if origin, ok := baseOrigins[objKey]; ok {
+				return nil, fmt.Errorf("%s: %+v is defined in both base %s and %s", srcKustomization, objKey, origin, base)
 			}
-			if obj.IsList() {
-				err := obj.EachListItem(func(item runtime.Object) error {
-					castItem := item.(*unstructured.Unstructured)
-					baseResources[ObjKey{
-						APIVersion: castItem.GetAPIVersion(),
-						Kind:       castItem.GetKind(),
-						Name:       castItem.GetName(),
-						Namespace:  castItem.GetNamespace(),
-					}] = castItem
-					return nil
-				})
+			baseResources[objKey] = obj
+			baseOrigins[objKey] = base
+		}
+	}
+
+	// objects kustomize generated with a content hash are compared under
+	// the names they are generated with, see unhashNames
+	hashed := takeHashed(baseResources)
+	for objKey := range takeHashed(targetResources) {
+		hashed[objKey] = true
+	}
+
+	for _, resources := range []map[ObjKey]*unstructured.Unstructured{baseResources, targetResources} {
+		for _, objKey := range SortedKeys(resources) {
+			if obj := resources[objKey]; IsCRD(obj) {
+				err = p.Schemas.AddCRD(obj)
 				if err != nil {
-					return err
+					return nil, err
 				}
-			} else {
-				baseResources[ObjKey{
-					APIVersion: obj.GetAPIVersion(),
-					Kind:       obj.GetKind(),
-					Name:       obj.GetName(),
-					Namespace:  obj.GetNamespace(),
-				}] = &obj
 			}
 		}
 	}
 
-	shortNames := sets.NewString()
-	var shortNameConflict bool
-	mediumNames := sets.NewString()
-	var mediumNameConflict bool
-	longNames := sets.NewString()
-	var longNameConflict bool
-	for objKey, targetResource := range targetResources {
-		if baseResource, ok := baseResources[objKey]; ok {
-			// generate patch
-			if IsOfficialType(objKey.APIVersion) {
-				shortName := "overlay.yaml"
-				mediumName := fmt.Sprintf("%s-overlay.yaml", baseResource.GetName())
-				longName := fmt.Sprintf("%s-%s-overlay.yaml", baseResource.GetName(), strings.ToLower(baseResource.GetKind()))
-
-				if shortNames.Has(shortName) {
-					shortNameConflict = true
-				} else {
-					shortNames.Insert(shortName)
-				}
+	// match the base objects with the variant after applying the namespace and
+	// name transformers inferred from their differences
+	baseDirs := make([]string, len(srcCfg.Bases))
+	for i, base := range srcCfg.Bases {
+		baseDirs[i] = filepath.Join(srcDir, base)
+	}
+	render, err := p.cache.BaseRenderer(baseDirs, baseResources)
+	if err != nil {
+		return nil, err
+	}
+	tb, err := TransformBase(baseResources, targetResources, render)
+	if err != nil {
+		return nil, err
+	}
+	tb, err = RenameBase(baseResources, targetResources, tb, p.OutputSchema)
+	if err != nil {
+		return nil, err
+	}
 
-				if mediumNames.Has(mediumName) {
-					mediumNameConflict = true
-				} else {
-					mediumNames.Insert(mediumName)
-				}
+	generators := PlanGenerators(tb, baseResources, targetResources, hashed, p.Generators)
 
-				if longNames.Has(longName) {
-					longNameConflict = true
-				} else {
-					longNames.Insert(longName)
-				}
+	var candidates [][]string
+	for objKey, targetResource := range targetResources {
+		if _, ok := generators[objKey]; ok {
+			// generator files
+			candidates = append(candidates, p.fileNames(targetResource, ""))
+		} else if transformedResource, ok := tb.Resources[objKey]; ok {
+			baseResource := baseResources[tb.Origins[objKey]]
+			if reflect.DeepEqual(transformedResource.Object, targetResource.Object) {
+				// unchanged
+				continue
+			}
+			// generate patch
+			if p.IsStrategicMergeType(baseResource) && transformedResource.GetAPIVersion() == targetResource.GetAPIVersion() {
+				candidates = append(candidates, p.fileNames(baseResource, "overlay"))
 			} else {
-				shortName := "patch.yaml"
-				mediumName := fmt.Sprintf("%s-patch.yaml", baseResource.GetName())
-				longName := fmt.Sprintf("%s-%s-patch.yaml", baseResource.GetName(), strings.ToLower(baseResource.GetKind()))
-
-				if shortNames.Has(shortName) {
-					shortNameConflict = true
-				} else {
-					shortNames.Insert(shortName)
-				}
-
-				if mediumNames.Has(mediumName) {
-					mediumNameConflict = true
-				} else {
-					mediumNames.Insert(mediumName)
-				}
-
-				if longNames.Has(longName) {
-					longNameConflict = true
-				} else {
-					longNames.Insert(longName)
-				}
+				candidates = append(candidates, p.fileNames(baseResource, "patch"))
 			}
 		} else {
 			// add resource
-			shortName := fmt.Sprintf("%s.yaml", targetResource.GetName())
-			mediumName := fmt.Sprintf("%s.yaml", targetResource.GetName())
-			longName := fmt.Sprintf("%s-%s.yaml", targetResource.GetName(), strings.ToLower(targetResource.GetKind()))
-
-			if shortNames.Has(shortName) {
-				shortNameConflict = true
-			} else {
-				shortNames.Insert(shortName)
-			}
-
-			if mediumNames.Has(mediumName) {
-				mediumNameConflict = true
-			} else {
-				mediumNames.Insert(mediumName)
-			}
-
-			if longNames.Has(longName) {
-				longNameConflict = true
-			} else {
-				longNames.Insert(longName)
-			}
+			candidates = append(candidates, p.fileNames(targetResource, ""))
 		}
 	}
-
-	const (
-		shortName  = "short"
-		mediumName = "medium"
-		longName   = "long"
-	)
-	var namesize string
-	if !shortNameConflict {
-		namesize = shortName
-	} else if !mediumNameConflict {
-		namesize = mediumName
-	} else if !longNameConflict {
-		namesize = longName
-	} else {
-		return fmt.Errorf("naming conflict for rootDir=%s variable=%#v", rootDir, xBase)
+	for objKey := range tb.Resources {
+		if _, ok := targetResources[objKey]; !ok {
+			// delete resource
+			candidates = append(candidates, p.fileNames(baseResources[tb.Origins[objKey]], "delete"))
+		}
+	}
+	for objKey := range tb.Renamed {
+		candidates = append(candidates, p.fileNames(baseResources[tb.Origins[objKey]], "rename"))
 	}
+	namer := newFileNamer(candidates)
 
-	targetCfg := types.Kustomization{
-		TypeMeta: types.TypeMeta{
-			APIVersion: types.KustomizationVersion,
-			Kind:       types.KustomizationKind,
-		},
+	o := &Overlay{
+		SrcDir: srcDir,
+		Dir:    dstDir,
+		Exact:  exact,
+		Files:  map[string][]byte{},
 	}
-	if dstBase != "" {
-		relativeBase, err := filepath.Rel(dstDir, dstBase)
-		if err != nil {
-			return err
+	for _, base := range dstBases {
+		if base != "" {
+			o.Bases = append(o.Bases, base)
 		}
-		targetCfg.Bases = []string{relativeBase}
 	}
 
-	for objKey, targetResource := range targetResources {
-		if baseResource, ok := baseResources[objKey]; ok {
+	// objects are processed in a stable order so that the generated
+	// kustomization lists its patches in the same order on every run
+	for _, objKey := range SortedKeys(tb.Resources, targetResources) {
+		transformedResource, inBase := tb.Resources[objKey]
+		baseResource := baseResources[tb.Origins[objKey]]
+		targetResource, inTarget := targetResources[objKey]
+		// patches address renamed objects by the name they have before the
+		// rename patch
+		selected := transformedResource
+		if renamed, ok := tb.Renamed[objKey]; ok {
+			selected = renamed
+		}
+		if g, ok := generators[objKey]; ok {
+			dir := strings.TrimSuffix(namer.Name(p.fileNames(targetResource, "")), ".yaml")
+			o.AddGenerator(dir, g)
+		} else if !inTarget {
+			// delete resource
+			names := p.fileNames(baseResource, "delete")
+
+			data, err := generateDeletePatch(baseResource)
+			if err != nil {
+				return nil, err
+			}
+			o.AddPatch(NewOverlayPatch(namer.Name(names), names, data, false, baseResource, transformedResource))
+		} else if inBase && reflect.DeepEqual(transformedResource.Object, targetResource.Object) {
+			// unchanged
+			continue
+		} else if inBase && transformedResource.GetAPIVersion() != targetResource.GetAPIVersion() {
+			// the variant moved the object to another version of its group
+			names := p.fileNames(baseResource, "patch")
+
+			patch, err := generateVersionPatch(transformedResource, targetResource)
+			if err != nil {
+				return nil, err
+			}
+			data, err := yaml2.Marshal(patch)
+			if err != nil {
+				return nil, err
+			}
+			o.AddPatch(NewOverlayPatch(namer.Name(names), names, data, true, baseResource, selected))
+		} else if inBase {
 			// generate patch
-			if IsOfficialType(objKey.APIVersion) {
-				var name string
-				if namesize == shortName {
-					name = "overlay.yaml"
-				} else if namesize == mediumName {
-					name = fmt.Sprintf("%s-overlay.yaml", baseResource.GetName())
-				} else if namesize == longName {
-					name = fmt.Sprintf("%s-%s-overlay.yaml", baseResource.GetName(), strings.ToLower(baseResource.GetKind()))
-				}
+			if p.IsStrategicMergeType(baseResource) {
+				names := p.fileNames(baseResource, "overlay")
 
-				data, err := generateStrategicMergePatch(baseResource, targetResource)
+				patchMeta, err := p.LookupPatchMeta(baseResource)
 				if err != nil {
-					return err
+					return nil, err
 				}
-				err = os.MkdirAll(dstDir, 0o755)
-				if err != nil {
-					return err
+				var openAPI []byte
+				if !IsOfficialType(baseResource.GetAPIVersion()) {
+					openAPI, err = p.Schemas.Document([]schema.GroupVersionKind{baseResource.GroupVersionKind()})
+					if err != nil {
+						return nil, err
+					}
 				}
-				err = os.WriteFile(filepath.Join(dstDir, name), data, 0o644)
+				data, err := generateStrategicMergePatch(baseResource, transformedResource, targetResource, patchMeta, openAPI)
 				if err != nil {
-					return err
+					return nil, err
 				}
-				targetCfg.PatchesStrategicMerge = append(targetCfg.PatchesStrategicMerge, types.PatchStrategicMerge(name))
+				patch := NewOverlayPatch(namer.Name(names), names, data, false, baseResource, selected)
+				patch.Schema = !IsOfficialType(baseResource.GetAPIVersion())
+				o.AddPatch(patch)
 			} else {
-				var name string
-				if namesize == shortName {
-					name = "patch.yaml"
-				} else if namesize == mediumName {
-					name = fmt.Sprintf("%s-patch.yaml", baseResource.GetName())
-				} else if namesize == longName {
-					name = fmt.Sprintf("%s-%s-patch.yaml", baseResource.GetName(), strings.ToLower(baseResource.GetKind()))
-				}
+				names := p.fileNames(baseResource, "patch")
 
-				err = os.MkdirAll(dstDir, 0o755)
+				patch, err := generateJsonPatch(transformedResource, targetResource)
 				if err != nil {
-					return err
-				}
-
-				patch, err := generateJsonPatch(baseResource, targetResource)
-				if err != nil {
-					return err
+					return nil, err
 				}
 				if len(patch) > 0 {
 					data, err := yaml2.Marshal(patch)
 					if err != nil {
-						return err
-					}
-					err = os.WriteFile(filepath.Join(dstDir, name), data, 0o644)
-					if err != nil {
-						return err
-					}
-
-					gv, err := schema.ParseGroupVersion(objKey.APIVersion)
-					if err != nil {
-						return err
+						return nil, err
 					}
-					targetCfg.PatchesJson6902 = append(targetCfg.PatchesJson6902, types.Patch{
-						Target: &types.Selector{
-							Gvk: resid.Gvk{
-								Group:   gv.Group,
-								Version: gv.Version,
-								Kind:    objKey.Kind,
-							},
-							Namespace: objKey.Namespace,
-							Name:      objKey.Name,
-						},
-						Path: name,
-					})
+					o.AddPatch(NewOverlayPatch(namer.Name(names), names, data, true, baseResource, selected))
 				}
 			}
 		} else {
 			// add resource
-			var name string
-			if namesize == shortName {
-				name = fmt.Sprintf("%s.yaml", targetResource.GetName())
-			} else if namesize == "" {
-				name = fmt.Sprintf("%s.yaml", targetResource.GetName())
-			} else if namesize == longName {
-				name = fmt.Sprintf("%s-%s.yaml", targetResource.GetName(), strings.ToLower(targetResource.GetKind()))
-			}
+			name := namer.Name(p.fileNames(targetResource, ""))
 
-			data, err := yaml2.Marshal(targetResource)
+			data, err := yaml2.Marshal(tb.Additions[objKey])
 			if err != nil {
-				return err
+				return nil, err
 			}
-			err = os.MkdirAll(dstDir, 0o755)
-			if err != nil {
-				return err
-			}
-			err = os.WriteFile(filepath.Join(dstDir, name), data, 0o644)
-			if err != nil {
-				return err
+			o.Files[name] = data
+			o.Cfg.Resources = append(o.Cfg.Resources, name)
+		}
+	}
+
+	// renames are applied last, since the other patches address the objects
+	// by their old names
+	for _, objKey := range SortedKeys(tb.Renamed) {
+		renamed := tb.Renamed[objKey]
+		baseResource := baseResources[tb.Origins[objKey]]
+		names := p.fileNames(baseResource, "rename")
+
+		name := targetResources[objKey].GetName()
+		if p.OutputSchema == OutputSchemaUnified {
+			// patches are applied before the name transformers
+			name = tb.Transforms.Reverse(targetResources[objKey]).GetName()
+		}
+		data, err := generateRenamePatch(name)
+		if err != nil {
+			return nil, err
+		}
+		patch := NewOverlayPatch(namer.Name(names), names, data, true, baseResource, renamed)
+		patch.Rename = true
+		o.AddPatch(patch)
+		fmt.Printf("%s renames %s to %s\n", srcDir, NewObjKey(renamed), objKey)
+	}
+
+	if o.needsSchema() {
+		var kinds []schema.GroupVersionKind
+		for _, resources := range []map[ObjKey]*unstructured.Unstructured{baseResources, targetResources} {
+			for _, obj := range resources {
+				kinds = append(kinds, obj.GroupVersionKind())
 			}
+		}
+		data, err := p.Schemas.Document(kinds)
+		if err != nil {
+			return nil, err
+		}
+		o.Files[openAPIFilename] = data
+		o.Cfg.OpenAPI = map[string]string{"path": openAPIFilename}
+	}
 
-			targetCfg.Resources = append(targetCfg.Resources, name)
+	tb.Transforms.Apply(&o.Cfg)
+	sort.Strings(o.Cfg.Resources)
+	if o.IsNoop() {
+		fmt.Printf("%s does not change its bases\n", srcDir)
+		if p.CollapseNoop && len(o.Bases) == 1 {
+			// later variants use the base in place of the variant
+			o.Collapsed = true
+			p.record(srcDir, o.Bases[0], nil)
+			return o, nil
 		}
 	}
+	p.record(srcDir, dstDir, &source{dir: srcDir, exact: exact})
+	return o, nil
+}
 
-	sort.Strings(targetCfg.Resources)
-	targetKustomization := filepath.Join(dstDir, "kustomization.yaml")
-	data, err := yaml2.Marshal(targetCfg)
-	if err != nil {
-		return err
+// hasExternalDir returns true if any of the resources of srcDir is a
+// directory outside of srcDir.
+func hasExternalDir(srcDir string, resources []string) bool {
+	for _, res := range resources {
+		path := filepath.Join(srcDir, res)
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			continue
+		}
+		if rel, err := filepath.Rel(srcDir, path); err != nil || strings.HasPrefix(rel, "..") {
+			return true
+		}
 	}
-	return os.WriteFile(targetKustomization, data, 0o644)
+	return false
 }
 
-func LoadKustomization(filename string) (*types.Kustomization, error) {
-	data, err := os.ReadFile(filename)
+// planRendered plans a kustomization in dstDir listing the objects rendered
+// from the kustomization in srcDir.
+func (p *Processor) planRendered(srcDir, dstDir string) (*Overlay, error) {
+	resources, err := Build(filesys.MakeFsOnDisk(), srcDir)
 	if err != nil {
 		return nil, err
 	}
-	var cfg types.Kustomization
-	err = yaml2.Unmarshal(data, &cfg)
-	if err != nil {
-		return nil, err
+	hashed := takeHashed(resources)
+	var candidates [][]string
+	for _, obj := range resources {
+		candidates = append(candidates, p.fileNames(obj, ""))
+	}
+	namer := newFileNamer(candidates)
+
+	o := &Overlay{
+		SrcDir: srcDir,
+		Dir:    dstDir,
+		Exact:  true,
+		Files:  map[string][]byte{},
+	}
+	for _, objKey := range SortedKeys(resources) {
+		name := namer.Name(p.fileNames(resources[objKey], ""))
+		if obj := resources[objKey]; hashed[objKey] && IsGeneratedType(obj) {
+			// only a generator appends the content hash to the name
+			o.AddGenerator(strings.TrimSuffix(name, ".yaml"), &Generator{
+				Obj:       obj,
+				Name:      obj.GetName(),
+				Namespace: obj.GetNamespace(),
+				Keys:      dataKeys(obj),
+				Hash:      true,
+			})
+			continue
+		}
+		data, err := yaml2.Marshal(resources[objKey])
+		if err != nil {
+			return nil, err
+		}
+		o.Files[name] = data
+		o.Cfg.Resources = append(o.Cfg.Resources, name)
+	}
+	sort.Strings(o.Cfg.Resources)
+	p.record(srcDir, dstDir, &source{dir: srcDir, exact: true})
+	return o, nil
+}
+
+// copyDir copies the files of the src directory on disk to dst.
+func (p *Processor) copyDir(dst, src string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return p.fs.MkdirAll(filepath.Join(dst, rel))
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return p.fs.WriteFile(filepath.Join(dst, rel), data)
+	})
+}
+
+// NewSelector returns a patch target that matches exactly obj.
+func NewSelector(obj *unstructured.Unstructured) *types.Selector {
+	gvk := obj.GroupVersionKind()
+	return &types.Selector{
+		Gvk: resid.Gvk{
+			Group:   gvk.Group,
+			Version: gvk.Version,
+			Kind:    gvk.Kind,
+		},
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+	}
+}
+
+// LoadResources decodes the objects stored in the given resource files of dir.
+func LoadResources(dir string, files []string) (map[ObjKey]*unstructured.Unstructured, error) {
+	resources := map[ObjKey]*unstructured.Unstructured{}
+	for _, res := range files {
+		data, err := os.ReadFile(filepath.Join(dir, res))
+		if err != nil {
+			return nil, err
+		}
+		err = DecodeResources(data, resources)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return &cfg, nil
+	return resources, nil
+}
+
+// DecodeResources adds the objects of a YAML or JSON stream to resources.
+func DecodeResources(data []byte, resources map[ObjKey]*unstructured.Unstructured) error {
+	reader := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 2048)
+	for {
+		var obj unstructured.Unstructured
+		err := reader.Decode(&obj)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if obj.IsList() {
+			err := obj.EachListItem(func(item runtime.Object) error {
+				castItem := item.(*unstructured.Unstructured)
+				resources[NewObjKey(castItem)] = castItem
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		} else {
+			resources[NewObjKey(&obj)] = &obj
+		}
+	}
+	return nil
+}
+
+// IsStrategicMergeType returns true if changes to obj are generated as
+// strategic merge patches rather than JSON patches.
+func (p *Processor) IsStrategicMergeType(obj *unstructured.Unstructured) bool {
+	return IsOfficialType(obj.GetAPIVersion()) || p.Schemas.Has(obj.GroupVersionKind())
+}
+
+// LookupPatchMeta returns the metadata used to generate strategic merge patches
+// for obj, taken from the Go types of official kinds or the schema of custom
+// resources.
+func (p *Processor) LookupPatchMeta(obj *unstructured.Unstructured) (strategicpatch.LookupPatchMeta, error) {
+	gvk := obj.GroupVersionKind()
+	if IsOfficialType(obj.GetAPIVersion()) {
+		dataStruct, err := scheme.Scheme.New(gvk)
+		if err != nil {
+			return nil, err
+		}
+		return strategicpatch.NewPatchMetaFromStruct(dataStruct)
+	}
+	if patchMeta := p.Schemas.PatchMeta(gvk); patchMeta != nil {
+		return patchMeta, nil
+	}
+	return nil, fmt.Errorf("no schema found for %v", gvk)
 }
 
 func IsOfficialType(apiVersion string) bool {
@@ -513,26 +1001,190 @@ func generateJsonPatch(fromObj, toObj *unstructured.Unstructured) ([]jsonpatch.O
 		return nil, err
 	}
 
+	// json.Marshal writes object keys in sorted order and CreatePatch emits
+	// operations in document order, so the patch is stable across runs.
 	return jsonpatch.CreatePatch(fromJson, toJson)
 }
 
-func generateStrategicMergePatch(fromObj, toObj *unstructured.Unstructured) ([]byte, error) {
-	obj, err := scheme.Scheme.New(fromObj.GetObjectKind().GroupVersionKind())
+// generateStrategicMergePatch returns the overlay that changes fromObj into
+// toObj, addressed to the base object obj. openAPI is the schema of custom
+// resources.
+func generateStrategicMergePatch(obj, fromObj, toObj *unstructured.Unstructured, patchMeta strategicpatch.LookupPatchMeta, openAPI []byte) ([]byte, error) {
+	overlay, err := strategicpatch.CreateTwoWayMergeMapPatchUsingLookupPatchMeta(fromObj.Object, toObj.Object, patchMeta)
 	if err != nil {
 		return nil, err
 	}
+	removeSetElementOrder(overlay)
+	// without $setElementOrder kustomize adds new items of merged lists in
+	// front of the existing ones, so lists are completed if the order of the
+	// variant is lost.
+	if !keepsOrder(fromObj, toObj, overlay, openAPI) {
+		completeLists(overlay, toObj.Object, patchMeta)
+	}
 
-	overlay, err := strategicpatch.CreateTwoWayMergeMapPatch(fromObj.Object, toObj.Object, obj)
+	overlay["apiVersion"] = obj.GetAPIVersion()
+	overlay["kind"] = obj.GetKind()
+	err = unstructured.SetNestedField(overlay, obj.GetName(), "metadata", "name")
 	if err != nil {
 		return nil, err
 	}
+	if obj.GetNamespace() != "" {
+		err = unstructured.SetNestedField(overlay, obj.GetNamespace(), "metadata", "namespace")
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	overlay["apiVersion"] = fromObj.GetAPIVersion()
-	overlay["kind"] = fromObj.GetKind()
-	err = unstructured.SetNestedField(overlay, fromObj.GetName(), "metadata", "name")
+	return yaml2.Marshal(overlay)
+}
+
+// keepsOrder returns true if kustomize turns fromObj into toObj when applying
+// the strategic merge patch overlay. The patch is applied with the filter of
+// kustomize rather than a full build, which is much slower and holds the
+// schema lock for longer. If kustomize fails to apply it, the overlay is kept
+// as is.
+func keepsOrder(fromObj, toObj *unstructured.Unstructured, overlay map[string]interface{}, openAPI []byte) bool {
+	patch := runtime.DeepCopyJSON(overlay)
+	patch["apiVersion"] = fromObj.GetAPIVersion()
+	patch["kind"] = fromObj.GetKind()
+	metadata, _, _ := unstructured.NestedMap(patch, "metadata")
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+	metadata["name"] = fromObj.GetName()
+	if fromObj.GetNamespace() != "" {
+		metadata["namespace"] = fromObj.GetNamespace()
+	}
+	patch["metadata"] = metadata
+	patchNode, err := kyaml.FromMap(patch)
 	if err != nil {
-		return nil, err
+		return true
+	}
+	node, err := kyaml.FromMap(fromObj.Object)
+	if err != nil {
+		return true
 	}
+	var data []byte
+	err = withSchema(openAPI, func() error {
+		nodes, err := patchstrategicmerge.Filter{Patch: patchNode}.Filter([]*kyaml.RNode{node})
+		if err != nil || len(nodes) == 0 || nodes[0] == nil {
+			return err
+		}
+		data, err = nodes[0].MarshalJSON()
+		return err
+	})
+	if err != nil || data == nil {
+		return true
+	}
+	rendered := &unstructured.Unstructured{}
+	if err := rendered.UnmarshalJSON(data); err != nil {
+		return true
+	}
+	return reflect.DeepEqual(rendered.Object, toObj.Object)
+}
 
-	return yaml2.Marshal(overlay)
+// completeLists lists the items of target missing from the merged lists of
+// the strategic merge patch by their merge key, so that kustomize produces
+// the items in the order of target.
+func completeLists(patch, target map[string]interface{}, patchMeta strategicpatch.LookupPatchMeta) {
+	for k, v := range patch {
+		if strings.HasPrefix(k, "$") {
+			continue
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			t, ok := target[k].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			meta, _, err := patchMeta.LookupPatchMetadataForStruct(k)
+			if err != nil {
+				continue
+			}
+			completeLists(v, t, meta)
+		case []interface{}:
+			t, ok := target[k].([]interface{})
+			if !ok {
+				continue
+			}
+			meta, pm, err := patchMeta.LookupPatchMetadataForSlice(k)
+			if err != nil || pm.GetPatchMergeKey() == "" {
+				continue
+			}
+			mergeKey := pm.GetPatchMergeKey()
+
+			items := map[string]map[string]interface{}{}
+			for _, item := range v {
+				if m, ok := item.(map[string]interface{}); ok && m[mergeKey] != nil && m["$patch"] == nil {
+					items[fmt.Sprint(m[mergeKey])] = m
+				}
+			}
+			list := make([]interface{}, 0, len(t))
+			used := sets.NewString()
+			for _, item := range t {
+				ti, ok := item.(map[string]interface{})
+				if !ok || ti[mergeKey] == nil {
+					continue
+				}
+				key := fmt.Sprint(ti[mergeKey])
+				if m, ok := items[key]; ok {
+					completeLists(m, ti, meta)
+					list = append(list, m)
+					used.Insert(key)
+				} else {
+					list = append(list, map[string]interface{}{mergeKey: ti[mergeKey]})
+				}
+			}
+			// directives and items not found in target keep their place after
+			// the listed items
+			for _, item := range v {
+				if m, ok := item.(map[string]interface{}); !ok || m[mergeKey] == nil || !used.Has(fmt.Sprint(m[mergeKey])) {
+					list = append(list, item)
+				}
+			}
+			patch[k] = list
+		}
+	}
+}
+
+// removeSetElementOrder drops the $setElementOrder directives from a strategic
+// merge patch, since kustomize does not understand them.
+func removeSetElementOrder(patch map[string]interface{}) {
+	for k, v := range patch {
+		if strings.HasPrefix(k, "$setElementOrder/") {
+			delete(patch, k)
+			continue
+		}
+		switch val := v.(type) {
+		case map[string]interface{}:
+			removeSetElementOrder(val)
+		case []interface{}:
+			for _, item := range val {
+				if m, ok := item.(map[string]interface{}); ok {
+					removeSetElementOrder(m)
+				}
+			}
+		}
+	}
+}
+
+// generateDeletePatch returns a strategic merge patch that removes obj. Kustomize
+// honours the $patch: delete directive for custom resources too.
+func generateDeletePatch(obj *unstructured.Unstructured) ([]byte, error) {
+	patch := map[string]interface{}{
+		"apiVersion": obj.GetAPIVersion(),
+		"kind":       obj.GetKind(),
+		"$patch":     "delete",
+	}
+	err := unstructured.SetNestedField(patch, obj.GetName(), "metadata", "name")
+	if err != nil {
+		return nil, err
+	}
+	if obj.GetNamespace() != "" {
+		err = unstructured.SetNestedField(patch, obj.GetNamespace(), "metadata", "namespace")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return yaml2.Marshal(patch)
 }
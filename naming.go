@@ -0,0 +1,167 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// FileNameData is passed to the file name template. Its fields are sanitised
+// so they can be used in file names.
+type FileNameData struct {
+	Name      string
+	Kind      string
+	Group     string
+	Version   string
+	Namespace string
+	// Type is overlay or patch for the strategic merge and JSON patches of an
+	// object, delete for the patch removing it, rename for the patch renaming
+	// it and empty for a full resource.
+	Type string
+}
+
+// ParseFileNameTemplate parses the file name template configured in
+// kustomizer.yaml and checks that it can be executed.
+func ParseFileNameTemplate(text string) (*template.Template, error) {
+	t, err := template.New("fileName").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file name template: %v", err)
+	}
+	var buf bytes.Buffer
+	err = t.Execute(&buf, FileNameData{Name: "name", Kind: "kind", Type: "patch"})
+	if err != nil {
+		return nil, fmt.Errorf("invalid file name template: %v", err)
+	}
+	return t, nil
+}
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// sanitizeFileName replaces the characters of s that are not safe to use in
+// file names, like the colons of RBAC object names.
+func sanitizeFileName(s string) string {
+	return unsafeFileNameChars.ReplaceAllString(s, "_")
+}
+
+// fileNames returns the file name candidates used to store the patch of the
+// given kind generated for obj, from the shortest to the most specific. An
+// empty kind means obj is stored as a full resource. The candidates are the
+// short, medium and long names, or the configured template in their place,
+// followed by the last of these with the namespace and then the group of obj
+// appended. Every object gets the same number of candidates.
+func (p *Processor) fileNames(obj *unstructured.Unstructured, kind string) []string {
+	gvk := obj.GroupVersionKind()
+	data := FileNameData{
+		Name:      sanitizeFileName(obj.GetName()),
+		Kind:      sanitizeFileName(strings.ToLower(gvk.Kind)),
+		Group:     sanitizeFileName(gvk.Group),
+		Version:   sanitizeFileName(gvk.Version),
+		Namespace: sanitizeFileName(obj.GetNamespace()),
+		Type:      kind,
+	}
+
+	var names []string
+	if p.FileNameTemplate != nil {
+		var buf bytes.Buffer
+		if err := p.FileNameTemplate.Execute(&buf, data); err == nil && buf.Len() > 0 {
+			names = []string{buf.String(), buf.String(), buf.String()}
+		}
+	}
+	if names == nil {
+		if kind == "" {
+			names = []string{data.Name, data.Name, data.Name + "-" + data.Kind}
+		} else {
+			names = []string{kind, data.Name + "-" + kind, data.Name + "-" + data.Kind + "-" + kind}
+		}
+	}
+	last := names[len(names)-1]
+	if data.Namespace != "" {
+		last += "-" + data.Namespace
+	}
+	names = append(names, last)
+	if data.Group != "" {
+		last += "-" + data.Group
+	}
+	names = append(names, last)
+
+	for i := range names {
+		names[i] += ".yaml"
+	}
+	return names
+}
+
+// reservedFileNames are the files of a generated kustomization that are not
+// named after an object.
+var reservedFileNames = []string{"kustomization.yaml", openAPIFilename}
+
+// fileNamer picks distinct file names for the files of a kustomization.
+type fileNamer struct {
+	// size is the index of the candidate used for every file.
+	size  int
+	taken sets.String
+}
+
+// newFileNamer returns a fileNamer using the shortest candidates that give
+// every file a distinct name, other than the reserved names. If even the most
+// specific candidates clash, the names picked later are numbered.
+func newFileNamer(candidates [][]string) *fileNamer {
+	n := &fileNamer{taken: sets.NewString(reservedFileNames...)}
+	if len(candidates) == 0 {
+		return n
+	}
+	sizes := len(candidates[0])
+	for _, c := range candidates {
+		if len(c) < sizes {
+			sizes = len(c)
+		}
+	}
+	for n.size = 0; n.size < sizes-1; n.size++ {
+		names := sets.NewString(reservedFileNames...)
+		conflict := false
+		for _, c := range candidates {
+			if names.Has(c[n.size]) {
+				conflict = true
+				break
+			}
+			names.Insert(c[n.size])
+		}
+		if !conflict {
+			break
+		}
+	}
+	return n
+}
+
+// Name returns the name picked from the candidates of a file.
+func (n *fileNamer) Name(candidates []string) string {
+	name := candidates[n.size]
+	if n.taken.Has(name) {
+		base := strings.TrimSuffix(name, ".yaml")
+		for i := 2; n.taken.Has(name); i++ {
+			name = fmt.Sprintf("%s-%d.yaml", base, i)
+		}
+	}
+	n.taken.Insert(name)
+	return name
+}
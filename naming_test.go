@@ -0,0 +1,138 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/kustomize/api/filesys"
+)
+
+func newObject(apiVersion, kind, namespace, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	return obj
+}
+
+func TestFileNames(t *testing.T) {
+	type file struct {
+		obj  *unstructured.Unstructured
+		kind string
+	}
+	cases := []struct {
+		name     string
+		template string
+		files    []file
+		want     []string
+	}{
+		{
+			name: "short names",
+			files: []file{
+				{obj: newObject("v1", "Service", "", "web"), kind: "overlay"},
+				{obj: newObject("v1", "ConfigMap", "", "config")},
+			},
+			want: []string{"overlay.yaml", "config.yaml"},
+		},
+		{
+			name: "clashing short names",
+			files: []file{
+				{obj: newObject("v1", "Service", "", "web"), kind: "overlay"},
+				{obj: newObject("apps/v1", "Deployment", "", "web"), kind: "overlay"},
+			},
+			want: []string{"web-service-overlay.yaml", "web-deployment-overlay.yaml"},
+		},
+		{
+			name: "clashing names in different namespaces",
+			files: []file{
+				{obj: newObject("v1", "Service", "a", "web"), kind: "overlay"},
+				{obj: newObject("v1", "Service", "b", "web"), kind: "overlay"},
+			},
+			want: []string{"web-service-overlay-a.yaml", "web-service-overlay-b.yaml"},
+		},
+		{
+			name: "reserved names",
+			files: []file{
+				{obj: newObject("v1", "ConfigMap", "", "kustomization")},
+				{obj: newObject("v1", "Service", "", "web"), kind: "overlay"},
+			},
+			want: []string{"kustomization-configmap.yaml", "web-service-overlay.yaml"},
+		},
+		{
+			name:     "reserved names from a template",
+			template: "{{.Name}}",
+			files: []file{
+				{obj: newObject("v1", "ConfigMap", "", "kustomization")},
+				{obj: newObject("v1", "Secret", "", "kustomization")},
+			},
+			want: []string{"kustomization-2.yaml", "kustomization-3.yaml"},
+		},
+		{
+			name:     "template",
+			template: "{{.Kind}}-{{.Name}}",
+			files: []file{
+				{obj: newObject("v1", "Service", "", "web"), kind: "overlay"},
+				{obj: newObject("v1", "ConfigMap", "", "config")},
+			},
+			want: []string{"service-web.yaml", "configmap-config.yaml"},
+		},
+		{
+			name:     "template empty for some objects",
+			template: "{{.Type}}",
+			files: []file{
+				{obj: newObject("v1", "ConfigMap", "", "config")},
+				{obj: newObject("v1", "Service", "", "web"), kind: "overlay"},
+				{obj: newObject("v1", "Service", "", "db"), kind: "overlay"},
+			},
+			want: []string{"config-configmap.yaml", "overlay.yaml", "overlay-2.yaml"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := NewProcessor(filesys.MakeFsInMemory())
+			if c.template != "" {
+				var err error
+				p.FileNameTemplate, err = ParseFileNameTemplate(c.template)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var candidates [][]string
+			for _, f := range c.files {
+				names := p.fileNames(f.obj, f.kind)
+				if len(candidates) > 0 && len(names) != len(candidates[0]) {
+					t.Errorf("%s has %d candidates, want %d", f.obj.GetName(), len(names), len(candidates[0]))
+				}
+				candidates = append(candidates, names)
+			}
+			namer := newFileNamer(candidates)
+			var got []string
+			for _, names := range candidates {
+				got = append(got, namer.Name(names))
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/kustomize/api/types"
+	yaml2 "sigs.k8s.io/yaml"
+)
+
+// Overlay is a kustomization planned by the processor that has not been
+// written yet.
+type Overlay struct {
+	// SrcDir is the input directory the overlay is generated from.
+	SrcDir string
+	// Dir is the directory the overlay is written to.
+	Dir string
+	// Copied is true when SrcDir is copied as is.
+	Copied bool
+	Exact  bool
+	// Component is true when the overlay is written as a kustomize Component.
+	Component bool
+	// Collapsed is true when the overlay does not change its only base and is
+	// not written. Later variants use the base instead.
+	Collapsed bool
+
+	// Bases and Components are the generated directories the overlay refers to.
+	Bases      []string
+	Components []string
+	// Cfg holds every field of the kustomization except its bases, components
+	// and patches.
+	Cfg types.Kustomization
+	// Files are the files written next to the kustomization, keyed by their
+	// path relative to Dir.
+	Files   map[string][]byte
+	Patches []*OverlayPatch
+}
+
+// OverlayPatch is a patch of an Overlay.
+type OverlayPatch struct {
+	Path string
+	// Names are the file name candidates of the patch.
+	Names []string
+	Data  []byte
+	// JSON is true for a JSON patch and false for a strategic merge patch.
+	JSON bool
+	// Schema is true when kustomize needs the OpenAPI schema of the overlay to
+	// apply the patch.
+	Schema bool
+	// Target matches the patched base object. TransformedTarget matches the
+	// same object after the namespace and name transformers of the overlay,
+	// which run before patchesJson6902 but after patches.
+	Target            *types.Selector
+	TransformedTarget *types.Selector
+	// Transformed is true when the transformers of the overlay change the
+	// patched object.
+	Transformed bool
+	// Rename is true for a JSON patch that renames the patched object. It
+	// follows the other patches of the object, which use its old name.
+	Rename bool
+}
+
+func NewOverlayPatch(path string, names []string, data []byte, json bool, obj, transformed *unstructured.Unstructured) *OverlayPatch {
+	return &OverlayPatch{
+		Path:              path,
+		Names:             names,
+		Data:              data,
+		JSON:              json,
+		Target:            NewSelector(obj),
+		TransformedTarget: NewSelector(transformed),
+		Transformed:       !reflect.DeepEqual(obj.Object, transformed.Object),
+	}
+}
+
+// IsNoop returns true if building the overlay produces the objects of its
+// bases unchanged.
+func (o *Overlay) IsNoop() bool {
+	return !o.Copied &&
+		len(o.Patches) == 0 &&
+		len(o.Components) == 0 &&
+		len(o.Files) == 0 &&
+		reflect.DeepEqual(o.Cfg, types.Kustomization{})
+}
+
+// BaseDir returns the directory later variants use as their base.
+func (o *Overlay) BaseDir() string {
+	if o.Collapsed {
+		return o.Bases[0]
+	}
+	return o.Dir
+}
+
+// AddPatch adds the patch to the overlay.
+func (o *Overlay) AddPatch(patch *OverlayPatch) {
+	o.Patches = append(o.Patches, patch)
+}
+
+// RemovePatch removes the patch stored in path from the overlay.
+func (o *Overlay) RemovePatch(path string) {
+	for i, patch := range o.Patches {
+		if patch.Path == path {
+			o.Patches = append(o.Patches[:i], o.Patches[i+1:]...)
+			return
+		}
+	}
+}
+
+// needsSchema returns true if any patch of the overlay needs its schema.
+func (o *Overlay) needsSchema() bool {
+	for _, patch := range o.Patches {
+		if patch.Schema {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteOverlay writes the files and the kustomization of o to its directory.
+func (p *Processor) WriteOverlay(o *Overlay) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if o.Copied {
+		return p.copyDir(o.Dir, o.SrcDir)
+	}
+	if o.Collapsed {
+		return nil
+	}
+
+	cfg := o.Cfg
+	cfg.TypeMeta = types.TypeMeta{
+		APIVersion: types.KustomizationVersion,
+		Kind:       types.KustomizationKind,
+	}
+	if o.Component {
+		cfg.TypeMeta = types.TypeMeta{
+			APIVersion: types.ComponentVersion,
+			Kind:       types.ComponentKind,
+		}
+	}
+	if !o.needsSchema() {
+		cfg.OpenAPI = nil
+	}
+
+	for _, patch := range o.Patches {
+		if p.OutputSchema == OutputSchemaUnified {
+			cfg.Patches = append(cfg.Patches, types.Patch{
+				Path:   patch.Path,
+				Target: patch.Target,
+			})
+		} else if !patch.JSON {
+			cfg.PatchesStrategicMerge = append(cfg.PatchesStrategicMerge, types.PatchStrategicMerge(patch.Path))
+		} else {
+			target := patch.TransformedTarget
+			if o.Component {
+				// components are applied before the transformers of the overlay
+				// that uses them
+				target = patch.Target
+			}
+			cfg.PatchesJson6902 = append(cfg.PatchesJson6902, types.Patch{
+				Path:   patch.Path,
+				Target: target,
+			})
+		}
+	}
+
+	relativeBases, err := relativePaths(o.Dir, o.Bases)
+	if err != nil {
+		return err
+	}
+	if p.OutputSchema == OutputSchemaUnified {
+		cfg.Resources = append(relativeBases, cfg.Resources...)
+	} else {
+		cfg.Bases = relativeBases
+	}
+	cfg.Components, err = relativePaths(o.Dir, o.Components)
+	if err != nil {
+		return err
+	}
+
+	err = p.fs.MkdirAll(o.Dir)
+	if err != nil {
+		return err
+	}
+	files := make([]string, 0, len(o.Files))
+	for name := range o.Files {
+		if name == openAPIFilename && cfg.OpenAPI == nil {
+			continue
+		}
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	for _, name := range files {
+		path := filepath.Join(o.Dir, name)
+		err = p.fs.MkdirAll(filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		err = p.fs.WriteFile(path, o.Files[name])
+		if err != nil {
+			return err
+		}
+	}
+	for _, patch := range o.Patches {
+		path := filepath.Join(o.Dir, patch.Path)
+		err = p.fs.MkdirAll(filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		err = p.fs.WriteFile(path, patch.Data)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := yaml2.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	return p.fs.WriteFile(filepath.Join(o.Dir, "kustomization.yaml"), data)
+}
+
+// relativePaths returns dirs relative to dir.
+func relativePaths(dir string, dirs []string) ([]string, error) {
+	var paths []string
+	for _, d := range dirs {
+		rel, err := filepath.Rel(dir, d)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, rel)
+	}
+	return paths, nil
+}
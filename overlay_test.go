@@ -0,0 +1,124 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/kustomize/api/types"
+	yaml2 "sigs.k8s.io/yaml"
+)
+
+func TestIsNoop(t *testing.T) {
+	cases := []struct {
+		name    string
+		overlay *Overlay
+		noop    bool
+	}{
+		{
+			name:    "bases only",
+			overlay: &Overlay{Bases: []string{"/out/base"}},
+			noop:    true,
+		},
+		{
+			name:    "copied",
+			overlay: &Overlay{Copied: true},
+		},
+		{
+			name:    "patch",
+			overlay: &Overlay{Bases: []string{"/out/base"}, Patches: []*OverlayPatch{{Path: "overlay.yaml"}}},
+		},
+		{
+			name:    "component",
+			overlay: &Overlay{Bases: []string{"/out/base"}, Components: []string{"/out/components/1"}},
+		},
+		{
+			name:    "file",
+			overlay: &Overlay{Bases: []string{"/out/base"}, Files: map[string][]byte{"cfg/A": nil}},
+		},
+		{
+			name:    "transformer",
+			overlay: &Overlay{Bases: []string{"/out/base"}, Cfg: types.Kustomization{Namespace: "prod"}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if noop := c.overlay.IsNoop(); noop != c.noop {
+				t.Errorf("expected %v, got %v", c.noop, noop)
+			}
+		})
+	}
+}
+
+func TestCollapseNoop(t *testing.T) {
+	cases := []struct {
+		name     string
+		collapse bool
+		// bases are the bases of the overlay generated for apps/x below a
+		bases []string
+	}{
+		{
+			name:  "written",
+			bases: []string{"../base"},
+		},
+		{
+			name:     "collapsed",
+			collapse: true,
+			bases:    []string{"../../base"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := newProcessor(OutputSchemaLegacy)
+			p.CollapseNoop = c.collapse
+			processTree(t, p, map[string]string{
+				"base/kustomization.yaml":   "resources:\n- all.yaml\n",
+				"base/all.yaml":             forkBase,
+				"env/a/kustomization.yaml":  "bases:\n- ../../base\nresources:\n- all.yaml\n",
+				"env/a/all.yaml":            forkBase,
+				"env/b/kustomization.yaml":  "bases:\n- ../../base\nnamespace: prod\n",
+				"apps/x/kustomization.yaml": "bases:\n- ../../base\nresources:\n- all.yaml\n",
+				"apps/x/all.yaml":           strings.Replace(forkBase, "port: 80", "port: 443", 1),
+			}, Variable{Base: "base"}, Variable{Dir: "env"}, Variable{Dir: "apps"})
+			if err := p.Verify(); err != nil {
+				t.Fatal(err)
+			}
+
+			if written := p.fs.Exists("/out/a/base/kustomization.yaml"); written == c.collapse {
+				t.Errorf("expected the no-op overlay to be written: %v, got %v", !c.collapse, written)
+			}
+			if !p.fs.Exists("/out/b/base/kustomization.yaml") {
+				t.Error("expected the overlay of b to be written")
+			}
+			data, err := p.fs.ReadFile("/out/a/x/kustomization.yaml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var kustomization types.Kustomization
+			if err := yaml2.Unmarshal(data, &kustomization); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(kustomization.Bases, c.bases) {
+				t.Errorf("expected bases %v, got %v", c.bases, kustomization.Bases)
+			}
+		})
+	}
+}
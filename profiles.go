@@ -0,0 +1,273 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// sourceDirs returns the input directories the variables generate overlays
+// for, in the order of the variables.
+func sourceDirs(rootDir string, vars []Variable) ([]string, error) {
+	var srcDirs []string
+	for _, v := range vars {
+		if v.Base != "" {
+			srcDirs = append(srcDirs, filepath.Join(rootDir, v.Base))
+			continue
+		}
+		dirVars, err := ioutil.ReadDir(filepath.Join(rootDir, v.Dir))
+		if err != nil {
+			return nil, err
+		}
+		for _, dirVar := range dirVars {
+			if dirVar.IsDir() {
+				srcDirs = append(srcDirs, filepath.Join(rootDir, v.Dir, dirVar.Name()))
+			}
+		}
+	}
+	return srcDirs, nil
+}
+
+// profileBases returns the input directories of a profile and the bases its
+// kustomizations use from outside of it. The first base of a variable other
+// than the first one is the variable before it. required holds the bases that
+// must be generated before the profile. optional holds the first bases of
+// the first variable, which are generated without their base if nothing
+// generates it.
+func profileBases(c *Cache, rootDir string, vars []Variable) (own, required, optional sets.String, err error) {
+	own, required, optional = sets.NewString(), sets.NewString(), sets.NewString()
+	for i, v := range vars {
+		srcDirs, err := sourceDirs(rootDir, []Variable{v})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, srcDir := range srcDirs {
+			own.Insert(srcDir)
+			cfg, err := c.LoadKustomization(filepath.Join(srcDir, "kustomization.yaml"))
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			for j, base := range cfg.Bases {
+				switch {
+				case j > 0:
+					required.Insert(filepath.Join(srcDir, base))
+				case i == 0:
+					optional.Insert(filepath.Join(srcDir, base))
+				}
+			}
+		}
+	}
+	return own, required.Difference(own), optional.Difference(own), nil
+}
+
+// OrderProfiles returns the profiles to process for the selected names, with
+// the input directory rootDir. The profiles that generate a base of a
+// selected profile are added to the selection, and every profile is processed
+// after the profiles it uses bases of. Profiles are processed in sorted order
+// otherwise.
+func (k *Kustomizer) OrderProfiles(rootDir string, names []string) ([]string, error) {
+	all, err := k.ProfileNames(nil)
+	if err != nil {
+		return nil, err
+	}
+	c := NewCache()
+	generatedBy := map[string][]string{}
+	bases := map[string]sets.String{}
+	for _, name := range all {
+		own, required, optional, err := profileBases(c, rootDir, k.Profiles[name])
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %v", name, err)
+		}
+		for _, srcDir := range own.List() {
+			generatedBy[srcDir] = append(generatedBy[srcDir], name)
+		}
+		bases[name] = required.Union(optional)
+	}
+	deps := map[string]sets.String{}
+	for _, name := range all {
+		deps[name] = sets.NewString()
+		for _, baseDir := range bases[name].List() {
+			for _, dep := range generatedBy[baseDir] {
+				if dep != name {
+					deps[name].Insert(dep)
+				}
+			}
+		}
+	}
+
+	selected := sets.NewString(names...)
+	for queue := names; len(queue) > 0; queue = queue[1:] {
+		for _, dep := range deps[queue[0]].List() {
+			if !selected.Has(dep) {
+				selected.Insert(dep)
+				queue = append(queue, dep)
+			}
+		}
+	}
+	var order []string
+	done := sets.NewString()
+	for done.Len() < selected.Len() {
+		var next string
+		for _, name := range selected.List() {
+			if !done.Has(name) && done.IsSuperset(deps[name]) {
+				next = name
+				break
+			}
+		}
+		if next == "" {
+			return nil, fmt.Errorf("profiles %s use the bases of each other", strings.Join(selected.Difference(done).List(), ", "))
+		}
+		order = append(order, next)
+		done.Insert(next)
+	}
+	return order, nil
+}
+
+// ProcessBases generates the additional bases of the variants of a profile
+// that no profile processed before it has generated, as if each was the only
+// variable of a profile of its own. They are written below dstDir under their
+// path in rootDir.
+func (p *Processor) ProcessBases(rootDir, dstDir string, vars []Variable) error {
+	return p.processBases(rootDir, dstDir, vars, sets.NewString())
+}
+
+func (p *Processor) processBases(rootDir, dstDir string, vars []Variable, visited sets.String) error {
+	_, required, _, err := profileBases(p.cache, rootDir, vars)
+	if err != nil {
+		return err
+	}
+	for _, baseDir := range required.List() {
+		if _, _, ok := p.lookup(baseDir); ok || visited.Has(baseDir) {
+			continue
+		}
+		visited.Insert(baseDir)
+		rel, err := filepath.Rel(rootDir, baseDir)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("base %s is outside of %s", baseDir, rootDir)
+		}
+		base := []Variable{{Base: rel}}
+		err = p.processBases(rootDir, dstDir, base, visited)
+		if err != nil {
+			return err
+		}
+		err = p.AddCRDs(rootDir, base)
+		if err != nil {
+			return err
+		}
+		err = p.ProcessDir(rootDir, "", filepath.Join(dstDir, filepath.Dir(rel)), base)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OutputDirs holds the entries of the output directory that some profiles
+// generate.
+type OutputDirs struct {
+	names sets.String
+	// shared is true if the intermediate bases and components of dir
+	// variables are generated in the output directory. Their names get a "_"
+	// prefix for every clash, see sharedDir.
+	shared bool
+}
+
+// Has returns true if the entry name of the output directory is generated by
+// the profiles.
+func (d *OutputDirs) Has(name string) bool {
+	shared := strings.TrimLeft(name, "_")
+	return d.names.Has(name) || d.shared && (shared == commonDir || shared == componentsDir)
+}
+
+// OutputDirs returns the entries of the output directory that the named
+// profiles generate, with the input directory rootDir, including the
+// additional bases that only they use and no profile generates.
+func (k *Kustomizer) OutputDirs(rootDir string, names []string) (*OutputDirs, error) {
+	d := &OutputDirs{names: sets.NewString()}
+	all, err := k.ProfileNames(nil)
+	if err != nil {
+		return nil, err
+	}
+	c := NewCache()
+	generated := sets.NewString()
+	onDemand := sets.NewString()
+	for _, name := range all {
+		own, required, _, err := profileBases(c, rootDir, k.Profiles[name])
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %v", name, err)
+		}
+		generated = generated.Union(own)
+		if sets.NewString(names...).Has(name) {
+			onDemand = onDemand.Union(required)
+			err = d.add(rootDir, k.Profiles[name])
+			if err != nil {
+				return nil, fmt.Errorf("profile %s: %v", name, err)
+			}
+		}
+	}
+	for _, baseDir := range onDemand.Difference(generated).List() {
+		rel, err := filepath.Rel(rootDir, baseDir)
+		if err != nil {
+			return nil, err
+		}
+		d.names.Insert(strings.Split(filepath.ToSlash(rel), "/")[0])
+	}
+	return d, nil
+}
+
+// add adds the entries generated by the variables of a profile, following
+// the layout of ProcessDir.
+func (d *OutputDirs) add(rootDir string, vars []Variable) error {
+	if len(vars) == 0 {
+		return nil
+	}
+	if vars[0].Base != "" {
+		name := filepath.Base(vars[0].Base)
+		d.names.Insert(name)
+		if len(vars) == 1 || name != "base" {
+			// the following variables are generated below name
+			return nil
+		}
+		err := d.add(rootDir, vars[1:])
+		if err != nil {
+			return err
+		}
+		if len(vars) > 2 && vars[1].Fork {
+			return d.add(rootDir, vars[2:])
+		}
+		return nil
+	}
+	dirVars, err := ioutil.ReadDir(filepath.Join(rootDir, vars[0].Dir))
+	if err != nil {
+		return err
+	}
+	for _, dirVar := range dirVars {
+		if dirVar.IsDir() {
+			d.names.Insert(dirVar.Name())
+		}
+	}
+	d.shared = true
+	return nil
+}
@@ -0,0 +1,203 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// profileTree has the bases app and mon, the variants of app using mon as an
+// additional base, a variant of mon and a variant of mon using app.
+var profileTree = map[string]string{
+	"app/kustomization.yaml":            "resources:\n- all.yaml\n",
+	"app/all.yaml":                      verifyDeployment,
+	"mon/kustomization.yaml":            "resources:\n- all.yaml\n",
+	"mon/all.yaml":                      "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: mon\n",
+	"variants/a/kustomization.yaml":     "bases:\n- ../../app\n- ../../mon\nresources:\n- all.yaml\n",
+	"variants/a/all.yaml":               verifyDeployment + "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: mon\n",
+	"mon-variants/x/kustomization.yaml": "bases:\n- ../../mon\nresources:\n- all.yaml\n",
+	"mon-variants/x/all.yaml":           "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: mon\ndata:\n  a: b\n",
+	"mixed/y/kustomization.yaml":        "bases:\n- ../../mon\n- ../../app\nresources:\n- all.yaml\n",
+	"mixed/y/all.yaml":                  verifyDeployment + "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: mon\n",
+}
+
+func TestOrderProfiles(t *testing.T) {
+	cases := []struct {
+		name     string
+		profiles map[string]Profile
+		selected []string
+		order    []string
+		invalid  bool
+	}{
+		{
+			name: "independent profiles",
+			profiles: map[string]Profile{
+				"b": {{Base: "mon"}},
+				"a": {{Base: "app"}},
+			},
+			selected: []string{"a", "b"},
+			order:    []string{"a", "b"},
+		},
+		{
+			name: "base generated by a profile sorted after",
+			profiles: map[string]Profile{
+				"app":        {{Base: "app"}, {Dir: "variants"}},
+				"monitoring": {{Base: "mon"}},
+			},
+			selected: []string{"app", "monitoring"},
+			order:    []string{"monitoring", "app"},
+		},
+		{
+			name: "selection with the profile of an additional base",
+			profiles: map[string]Profile{
+				"app":        {{Base: "app"}, {Dir: "variants"}},
+				"monitoring": {{Base: "mon"}},
+				"other":      {{Base: "mon"}, {Dir: "mon-variants"}},
+			},
+			selected: []string{"app"},
+			order:    []string{"monitoring", "other", "app"},
+		},
+		{
+			name: "first base of the first variable",
+			profiles: map[string]Profile{
+				"a": {{Dir: "mon-variants"}},
+				"b": {{Base: "mon"}},
+			},
+			selected: []string{"a", "b"},
+			order:    []string{"b", "a"},
+		},
+		{
+			name: "chain of profiles",
+			profiles: map[string]Profile{
+				"a": {{Base: "app"}, {Dir: "variants"}},
+				"b": {{Base: "mon"}, {Dir: "mon-variants"}},
+				"c": {{Base: "variants/a"}},
+			},
+			selected: []string{"a", "b", "c"},
+			order:    []string{"b", "a", "c"},
+		},
+		{
+			name: "cycle",
+			profiles: map[string]Profile{
+				"a": {{Base: "app"}, {Dir: "variants"}},
+				"b": {{Base: "mon"}, {Dir: "mixed"}},
+			},
+			selected: []string{"a", "b"},
+			invalid:  true,
+		},
+	}
+
+	rootDir := writeTree(t, profileTree)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &Kustomizer{Profiles: c.profiles}
+			order, err := cfg.OrderProfiles(rootDir, c.selected)
+			if c.invalid {
+				if err == nil {
+					t.Errorf("expected an error, got %v", order)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(order, c.order) {
+				t.Errorf("got %v, want %v", order, c.order)
+			}
+		})
+	}
+}
+
+func TestProcessBasesOnDemand(t *testing.T) {
+	for _, outputSchema := range []OutputSchema{OutputSchemaLegacy, OutputSchemaUnified} {
+		t.Run(string(outputSchema), func(t *testing.T) {
+			p := processTree(t, newProcessor(outputSchema), profileTree, Variable{Base: "app"}, Variable{Dir: "variants"})
+			if _, err := p.fs.ReadFile("/out/mon/kustomization.yaml"); err != nil {
+				t.Errorf("additional base not generated: %v", err)
+			}
+			if err := p.Verify(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestOutputDirs(t *testing.T) {
+	cases := []struct {
+		name     string
+		profiles map[string]Profile
+		names    []string
+		has      []string
+		hasNot   []string
+	}{
+		{
+			name: "variants next to the base",
+			profiles: map[string]Profile{
+				"a": {{Base: "base"}, {Dir: "variants"}},
+			},
+			names:  []string{"a"},
+			has:    []string{"base", "a", "common", "_components"},
+			hasNot: []string{"app", "variants"},
+		},
+		{
+			name: "variants below the base",
+			profiles: map[string]Profile{
+				"a": {{Base: "mon"}, {Dir: "mon-variants"}},
+			},
+			names:  []string{"a"},
+			has:    []string{"mon"},
+			hasNot: []string{"x", "common"},
+		},
+		{
+			name: "bases generated on demand",
+			profiles: map[string]Profile{
+				"a": {{Base: "mon"}},
+				"b": {{Base: "base"}, {Dir: "mixed"}},
+			},
+			names:  []string{"b"},
+			has:    []string{"base", "y", "app"},
+			hasNot: []string{"mon"},
+		},
+	}
+
+	files := map[string]string{}
+	for name, data := range profileTree {
+		files[name] = data
+	}
+	files["base/kustomization.yaml"] = "resources: []\n"
+	rootDir := writeTree(t, files)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &Kustomizer{Profiles: c.profiles}
+			dirs, err := cfg.OutputDirs(rootDir, c.names)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range c.has {
+				if !dirs.Has(name) {
+					t.Errorf("%s is not generated", name)
+				}
+			}
+			for _, name := range c.hasNot {
+				if dirs.Has(name) {
+					t.Errorf("%s is generated", name)
+				}
+			}
+		})
+	}
+}
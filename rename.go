@@ -0,0 +1,260 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gomodules.xyz/jsonpatch/v3"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/kustomize/api/types"
+	yaml2 "sigs.k8s.io/yaml"
+)
+
+// renameSimilarity is the share of fields that an object removed from the
+// bases and an object added by the variant must have in common to be treated
+// as the same object under a new name.
+const renameSimilarity = 0.5
+
+type renamePair struct {
+	from, to   ObjKey
+	similarity float64
+}
+
+// RenameBase pairs the transformed base objects missing from the variant with
+// the variant objects of the same apiVersion, kind and namespace that are
+// missing from the bases, if their fields are similar enough. Every object is
+// paired at most once, the most similar pairs first. The paired base objects
+// are renamed by JSON patches placed like those of the generated overlay, so
+// that references to them are updated the way kustomize does when building
+// it. A pair is only renamed if every base object that refers to it refers
+// to the new name in the variant, as kustomize updates all references. tb is
+// returned as is if there is nothing to rename.
+func RenameBase(base, target map[ObjKey]*unstructured.Unstructured, tb *TransformedBase, schema OutputSchema) (*TransformedBase, error) {
+	pairs := pairRenames(tb, target)
+	for len(pairs) > 0 {
+		renamed, err := renameBase(base, tb, pairs, schema)
+		if err != nil || renamed == tb {
+			return renamed, err
+		}
+		followed := followedRenames(tb, renamed, target, pairs)
+		if len(followed) == len(pairs) {
+			return renamed, nil
+		}
+		pairs = followed
+	}
+	return tb, nil
+}
+
+// renameBase renames the base objects of pairs. tb is returned as is if
+// kustomize can not apply the renames.
+func renameBase(base map[ObjKey]*unstructured.Unstructured, tb *TransformedBase, pairs []renamePair, schema OutputSchema) (*TransformedBase, error) {
+	var inputs []*unstructured.Unstructured
+	var inputKeys []ObjKey
+	for _, objKey := range SortedKeys(base) {
+		inputs = append(inputs, base[objKey])
+		inputKeys = append(inputKeys, objKey)
+	}
+	var patches, jsonPatches []types.Patch
+	for _, pair := range pairs {
+		if schema == OutputSchemaUnified {
+			// patches are applied to the base objects before the transformers,
+			// so the object gets the name of the addition
+			data, err := generateRenamePatch(tb.Additions[pair.to].GetName())
+			if err != nil {
+				return nil, err
+			}
+			patches = append(patches, types.Patch{
+				Patch:  string(data),
+				Target: NewSelector(base[tb.Origins[pair.from]]),
+			})
+		} else {
+			data, err := generateRenamePatch(pair.to.Name)
+			if err != nil {
+				return nil, err
+			}
+			jsonPatches = append(jsonPatches, types.Patch{
+				Patch:  string(data),
+				Target: NewSelector(tb.Resources[pair.from]),
+			})
+		}
+	}
+	rendered, err := renderTransformed(inputs, tb.Transforms, patches, jsonPatches, nil)
+	if err != nil {
+		// kustomize can not apply the renames
+		return tb, nil
+	}
+
+	renamed := &TransformedBase{
+		Transforms:        tb.Transforms,
+		Resources:         map[ObjKey]*unstructured.Unstructured{},
+		Origins:           map[ObjKey]ObjKey{},
+		Additions:         map[ObjKey]*unstructured.Unstructured{},
+		Renamed:           map[ObjKey]*unstructured.Unstructured{},
+		renderedAdditions: map[ObjKey]*unstructured.Unstructured{},
+	}
+	for i, obj := range rendered {
+		objKey := NewObjKey(obj)
+		renamed.Resources[objKey] = obj
+		renamed.Origins[objKey] = inputKeys[i]
+	}
+	for _, pair := range pairs {
+		if _, ok := renamed.Resources[pair.to]; !ok {
+			return tb, nil
+		}
+		renamed.Renamed[pair.to] = tb.Resources[pair.from]
+	}
+	for objKey, obj := range tb.Additions {
+		if _, ok := renamed.Renamed[objKey]; ok {
+			continue
+		}
+		renamed.Additions[objKey] = obj
+		if r, ok := tb.renderedAdditions[objKey]; ok {
+			renamed.renderedAdditions[objKey] = r
+		}
+	}
+	return renamed, nil
+}
+
+// followedRenames returns the pairs whose new name is used by every base
+// object of the variant that kustomize changed when renaming.
+func followedRenames(tb, renamed *TransformedBase, target map[ObjKey]*unstructured.Unstructured, pairs []renamePair) []renamePair {
+	unfollowed := map[ObjKey]bool{}
+	for objKey, obj := range tb.Resources {
+		renamedObj, ok := renamed.Resources[objKey]
+		if !ok {
+			continue
+		}
+		targetObj, ok := target[objKey]
+		if !ok {
+			continue
+		}
+		fields, renamedFields, targetFields := sets.NewString(), sets.NewString(), sets.NewString()
+		collectFields(obj.Object, "", fields)
+		collectFields(renamedObj.Object, "", renamedFields)
+		collectFields(targetObj.Object, "", targetFields)
+		for _, field := range renamedFields.Difference(fields).Difference(targetFields).UnsortedList() {
+			for _, pair := range pairs {
+				if strings.HasSuffix(field, "="+pair.to.Name) {
+					unfollowed[pair.to] = true
+				}
+			}
+		}
+	}
+
+	var followed []renamePair
+	for _, pair := range pairs {
+		if !unfollowed[pair.to] {
+			followed = append(followed, pair)
+		}
+	}
+	return followed
+}
+
+// pairRenames returns the rename candidates of tb, the most similar first.
+func pairRenames(tb *TransformedBase, target map[ObjKey]*unstructured.Unstructured) []renamePair {
+	var candidates []renamePair
+	fingerprints := map[ObjKey]sets.String{}
+	for _, from := range SortedKeys(tb.Resources) {
+		if _, ok := target[from]; ok {
+			continue
+		}
+		fromObj := tb.Resources[from]
+		for _, to := range SortedKeys(target) {
+			if _, ok := tb.Resources[to]; ok {
+				continue
+			}
+			toObj := target[to]
+			if to.Group != from.Group || to.Kind != from.Kind || to.Namespace != from.Namespace ||
+				toObj.GetAPIVersion() != fromObj.GetAPIVersion() {
+				continue
+			}
+			if _, ok := fingerprints[from]; !ok {
+				fingerprints[from] = fingerprint(fromObj)
+			}
+			if _, ok := fingerprints[to]; !ok {
+				fingerprints[to] = fingerprint(toObj)
+			}
+			s := similarity(fingerprints[from], fingerprints[to])
+			if s >= renameSimilarity {
+				candidates = append(candidates, renamePair{from: from, to: to, similarity: s})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].similarity > candidates[j].similarity
+	})
+
+	var pairs []renamePair
+	paired := map[ObjKey]bool{}
+	for _, c := range candidates {
+		if !paired[c.from] && !paired[c.to] {
+			pairs = append(pairs, c)
+			paired[c.from] = true
+			paired[c.to] = true
+		}
+	}
+	return pairs
+}
+
+// fingerprint returns the fields of obj as path=value strings, leaving out
+// the fields that identify it.
+func fingerprint(obj *unstructured.Unstructured) sets.String {
+	content := obj.DeepCopy().Object
+	delete(content, "apiVersion")
+	delete(content, "kind")
+	unstructured.RemoveNestedField(content, "metadata", "name")
+	unstructured.RemoveNestedField(content, "metadata", "namespace")
+	fields := sets.NewString()
+	collectFields(content, "", fields)
+	return fields
+}
+
+func collectFields(v interface{}, path string, fields sets.String) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			collectFields(child, path+"/"+k, fields)
+		}
+	case []interface{}:
+		for i, child := range v {
+			collectFields(child, path+"/"+strconv.Itoa(i), fields)
+		}
+	default:
+		fields.Insert(fmt.Sprintf("%s=%v", path, v))
+	}
+}
+
+// similarity returns the share of fields a and b have in common.
+func similarity(a, b sets.String) float64 {
+	all := a.Union(b)
+	if all.Len() == 0 {
+		return 1
+	}
+	return float64(a.Intersection(b).Len()) / float64(all.Len())
+}
+
+// generateRenamePatch returns the JSON patch that renames an object to name.
+func generateRenamePatch(name string) ([]byte, error) {
+	return yaml2.Marshal([]jsonpatch.Operation{
+		{Operation: "replace", Path: "/metadata/name", Value: name},
+	})
+}
@@ -0,0 +1,143 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// newConfigMap returns a ConfigMap with data.
+func newConfigMap(name string, data map[string]interface{}) *unstructured.Unstructured {
+	obj := newObject("v1", "ConfigMap", "", name)
+	obj.Object["data"] = data
+	return obj
+}
+
+func TestPairRenames(t *testing.T) {
+	cases := []struct {
+		name     string
+		from, to map[string]interface{}
+		paired   bool
+	}{
+		{
+			name:   "identical",
+			from:   map[string]interface{}{"a": "1", "b": "2"},
+			to:     map[string]interface{}{"a": "1", "b": "2"},
+			paired: true,
+		},
+		{
+			name:   "half of the fields in common",
+			from:   map[string]interface{}{"a": "1", "b": "2", "c": "3"},
+			to:     map[string]interface{}{"a": "1", "b": "2", "d": "4"},
+			paired: true,
+		},
+		{
+			name: "less than half of the fields in common",
+			from: map[string]interface{}{"a": "1", "b": "2"},
+			to:   map[string]interface{}{"a": "1", "c": "3"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			from := newConfigMap("old", c.from)
+			to := newConfigMap("new", c.to)
+			tb := &TransformedBase{Resources: map[ObjKey]*unstructured.Unstructured{NewObjKey(from): from}}
+			pairs := pairRenames(tb, map[ObjKey]*unstructured.Unstructured{NewObjKey(to): to})
+
+			var want []ObjKey
+			if c.paired {
+				want = []ObjKey{NewObjKey(from), NewObjKey(to)}
+			}
+			var got []ObjKey
+			for _, pair := range pairs {
+				got = append(got, pair.from, pair.to)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got pairs %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+const renameResources = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: old
+data:
+  A: "1"
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  selector:
+    matchLabels:
+      app: web
+  template:
+    metadata:
+      labels:
+        app: web
+    spec:
+      containers:
+      - name: web
+        image: nginx
+        envFrom:
+        - configMapRef:
+            name: old
+`
+
+func TestVerifyRenames(t *testing.T) {
+	cases := []struct {
+		name string
+		// the variant replaces old with new in the base resources
+		old, new string
+	}{
+		{
+			name: "renamed with its referrers",
+			old:  "name: old\n",
+			new:  "name: new\n",
+		},
+		{
+			name: "referrers keep the old name",
+			old:  "metadata:\n  name: old\n",
+			new:  "metadata:\n  name: new\n",
+		},
+	}
+
+	for _, c := range cases {
+		for _, outputSchema := range []OutputSchema{OutputSchemaLegacy, OutputSchemaUnified} {
+			t.Run(c.name+"/"+string(outputSchema), func(t *testing.T) {
+				p := processTree(t, newProcessor(outputSchema), map[string]string{
+					"base/kustomization.yaml":       "resources:\n- all.yaml\n",
+					"base/all.yaml":                 renameResources,
+					"variants/a/kustomization.yaml": verifyKustomization,
+					"variants/a/all.yaml":           strings.Replace(renameResources, c.old, c.new, -1),
+				}, Variable{Base: "base"}, Variable{Dir: "variants"})
+				if err := p.Verify(); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
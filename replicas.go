@@ -0,0 +1,85 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/kustomize/api/types"
+)
+
+// scalableKinds are the kinds whose spec.replicas is set by the kustomize
+// replicas transformer.
+var scalableKinds = sets.NewString("Deployment", "ReplicationController", "ReplicaSet", "StatefulSet")
+
+// inferReplicas returns the replicas transformers for the base objects of a
+// scalable kind whose replica count is the only difference to the variant.
+func inferReplicas(tb *TransformedBase, target map[ObjKey]*unstructured.Unstructured) []types.Replica {
+	var replicas []types.Replica
+	for _, objKey := range SortedKeys(tb.Resources) {
+		targetObj, ok := target[objKey]
+		if !ok || !scalableKinds.Has(objKey.Kind) {
+			continue
+		}
+		obj := tb.Resources[objKey]
+		count, ok, err := unstructured.NestedInt64(targetObj.Object, "spec", "replicas")
+		if err != nil || !ok {
+			continue
+		}
+		patch, err := generateJsonPatch(obj, targetObj)
+		if err != nil || len(patch) != 1 || patch[0].Path != "/spec/replicas" {
+			continue
+		}
+		replicas = append(replicas, types.Replica{
+			Name:  tb.Origins[objKey].Name,
+			Count: count,
+		})
+	}
+	return replicas
+}
+
+// replicaConflicts returns the names of the replicas transformers that set the
+// replica count of an object to a value the variant does not have. The
+// transformers match objects of any scalable kind by name only.
+func (tb *TransformedBase) replicaConflicts(target map[ObjKey]*unstructured.Unstructured) sets.String {
+	names := sets.NewString()
+	for _, r := range tb.Transforms.Replicas {
+		names.Insert(r.Name)
+	}
+	conflicts := sets.NewString()
+	check := func(objKey ObjKey, obj *unstructured.Unstructured, name string) {
+		targetObj, ok := target[objKey]
+		if !ok || !scalableKinds.Has(objKey.Kind) {
+			return
+		}
+		if !names.Has(name) && !names.Has(obj.GetName()) {
+			return
+		}
+		count, found, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+		targetCount, targetFound, _ := unstructured.NestedInt64(targetObj.Object, "spec", "replicas")
+		if count != targetCount || found != targetFound {
+			conflicts.Insert(name, obj.GetName())
+		}
+	}
+	for objKey, obj := range tb.Resources {
+		check(objKey, obj, tb.Origins[objKey].Name)
+	}
+	for objKey, obj := range tb.renderedAdditions {
+		check(objKey, obj, tb.Additions[objKey].GetName())
+	}
+	return conflicts
+}
@@ -0,0 +1,130 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/kustomize/api/types"
+	yaml2 "sigs.k8s.io/yaml"
+)
+
+// scaledObject returns an object of a scalable kind with the given replica
+// count and container image.
+func scaledObject(kind, name, replicas, image string) string {
+	return `
+apiVersion: apps/v1
+kind: ` + kind + `
+metadata:
+  name: ` + name + `
+spec:
+  replicas: ` + replicas + `
+  selector:
+    matchLabels:
+      app: ` + name + `
+  template:
+    metadata:
+      labels:
+        app: ` + name + `
+    spec:
+      containers:
+      - name: main
+        image: ` + image + `
+        args:
+        - --port=80
+`
+}
+
+func TestReplicas(t *testing.T) {
+	base := scaledObject("Deployment", "web", "1", "nginx") + "---" + scaledObject("StatefulSet", "db", "1", "postgres")
+	cases := []struct {
+		name string
+		// base defaults to a Deployment and a StatefulSet of other names
+		base     string
+		target   string
+		replicas []types.Replica
+		patched  bool
+	}{
+		{
+			name:     "replicas only",
+			target:   strings.Replace(base, "replicas: 1", "replicas: 3", -1),
+			replicas: []types.Replica{{Name: "web", Count: 3}, {Name: "db", Count: 3}},
+		},
+		{
+			name:     "replicas of one object",
+			target:   strings.Replace(base, "replicas: 1", "replicas: 3", 1),
+			replicas: []types.Replica{{Name: "web", Count: 3}},
+		},
+		{
+			name:    "replicas and other fields",
+			target:  strings.Replace(strings.Replace(base, "replicas: 1", "replicas: 3", -1), "--port=80", "--port=8080", -1),
+			patched: true,
+		},
+		{
+			name: "replicas and other fields of one object",
+			target: scaledObject("Deployment", "web", "3", "nginx") + "---" +
+				strings.Replace(scaledObject("StatefulSet", "db", "3", "postgres"), "--port=80", "--port=8080", 1),
+			replicas: []types.Replica{{Name: "web", Count: 3}},
+			patched:  true,
+		},
+		{
+			name:    "object of another kind with the same name",
+			base:    scaledObject("Deployment", "web", "1", "nginx") + "---" + scaledObject("StatefulSet", "web", "1", "redis"),
+			target:  scaledObject("Deployment", "web", "3", "nginx") + "---" + scaledObject("StatefulSet", "web", "1", "redis"),
+			patched: true,
+		},
+	}
+
+	for _, c := range cases {
+		for _, outputSchema := range []OutputSchema{OutputSchemaLegacy, OutputSchemaUnified} {
+			t.Run(c.name+"/"+string(outputSchema), func(t *testing.T) {
+				baseResources := c.base
+				if baseResources == "" {
+					baseResources = base
+				}
+				p := processTree(t, newProcessor(outputSchema), map[string]string{
+					"base/kustomization.yaml":       "resources:\n- all.yaml\n",
+					"base/all.yaml":                 baseResources,
+					"variants/a/kustomization.yaml": verifyKustomization,
+					"variants/a/all.yaml":           c.target,
+				}, Variable{Base: "base"}, Variable{Dir: "variants"})
+				if err := p.Verify(); err != nil {
+					t.Fatal(err)
+				}
+
+				data, err := p.fs.ReadFile("/out/a/kustomization.yaml")
+				if err != nil {
+					t.Fatal(err)
+				}
+				var kustomization types.Kustomization
+				if err := yaml2.Unmarshal(data, &kustomization); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(kustomization.Replicas, c.replicas) {
+					t.Errorf("expected replicas %v, got %v", c.replicas, kustomization.Replicas)
+				}
+				patched := len(kustomization.PatchesStrategicMerge) > 0 || len(kustomization.PatchesJson6902) > 0 ||
+					len(kustomization.Patches) > 0
+				if patched != c.patched {
+					t.Errorf("expected patches %v, got\n%s", c.patched, data)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,473 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/kube-openapi/pkg/util/proto"
+	"sigs.k8s.io/kustomize/kyaml/openapi/kubernetesapi"
+	yaml2 "sigs.k8s.io/yaml"
+)
+
+const (
+	extGroupVersionKind = "x-kubernetes-group-version-kind"
+	extPatchStrategy    = "x-kubernetes-patch-strategy"
+	extPatchMergeKey    = "x-kubernetes-patch-merge-key"
+	extListType         = "x-kubernetes-list-type"
+	extListMapKeys      = "x-kubernetes-list-map-keys"
+
+	definitionRefPrefix = "#/definitions/"
+)
+
+// Schemas indexes the OpenAPI definitions of custom resources, loaded from
+// CustomResourceDefinitions and OpenAPI documents found in the input tree.
+type Schemas struct {
+	// mu guards the definitions, since variants are processed concurrently.
+	mu sync.RWMutex
+
+	definitions map[string]map[string]interface{}
+	gvks        map[schema.GroupVersionKind]string
+
+	builtin     map[string]map[string]interface{}
+	builtinGVKs map[schema.GroupVersionKind]string
+}
+
+func NewSchemas() *Schemas {
+	return &Schemas{
+		definitions: map[string]map[string]interface{}{},
+		gvks:        map[schema.GroupVersionKind]string{},
+	}
+}
+
+// Load reads the CustomResourceDefinitions and OpenAPI documents found in the
+// given files or directories of rootDir.
+func (s *Schemas) Load(rootDir string, crds, openapi []string) error {
+	for _, path := range crds {
+		files, err := listFiles(filepath.Join(rootDir, path))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			resources, err := LoadResources(filepath.Dir(file), []string{filepath.Base(file)})
+			if err != nil {
+				return err
+			}
+			for _, obj := range resources {
+				if IsCRD(obj) {
+					err = s.AddCRD(obj)
+					if err != nil {
+						return fmt.Errorf("%s: %v", file, err)
+					}
+				}
+			}
+		}
+	}
+	for _, path := range openapi {
+		files, err := listFiles(filepath.Join(rootDir, path))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			err = s.AddOpenAPI(data)
+			if err != nil {
+				return fmt.Errorf("%s: %v", file, err)
+			}
+		}
+	}
+	return nil
+}
+
+func listFiles(path string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch filepath.Ext(path) {
+		case ".yaml", ".yml", ".json":
+			if !info.IsDir() {
+				files = append(files, path)
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+func IsCRD(obj *unstructured.Unstructured) bool {
+	gvk := obj.GroupVersionKind()
+	return gvk.Group == "apiextensions.k8s.io" && gvk.Kind == "CustomResourceDefinition"
+}
+
+// AddCRD indexes the structural schema of every version served by the given
+// CustomResourceDefinition.
+func (s *Schemas) AddCRD(crd *unstructured.Unstructured) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group, _, err := unstructured.NestedString(crd.Object, "spec", "group")
+	if err != nil {
+		return err
+	}
+	kind, _, err := unstructured.NestedString(crd.Object, "spec", "names", "kind")
+	if err != nil {
+		return err
+	}
+
+	// apiextensions.k8s.io/v1beta1 allows a single schema shared by all versions
+	shared, _, err := unstructured.NestedMap(crd.Object, "spec", "validation", "openAPIV3Schema")
+	if err != nil {
+		return err
+	}
+	versions, _, err := unstructured.NestedSlice(crd.Object, "spec", "versions")
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		if version, _, _ := unstructured.NestedString(crd.Object, "spec", "version"); version != "" {
+			versions = append(versions, map[string]interface{}{"name": version})
+		}
+	}
+	for _, v := range versions {
+		version, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(version, "name")
+		def, ok, err := unstructured.NestedMap(version, "schema", "openAPIV3Schema")
+		if err != nil {
+			return err
+		}
+		if !ok && shared != nil {
+			def = runtime.DeepCopyJSON(shared)
+		}
+		if def == nil || name == "" {
+			continue
+		}
+
+		gvk := schema.GroupVersionKind{Group: group, Version: name, Kind: kind}
+		def[extGroupVersionKind] = []interface{}{
+			map[string]interface{}{"group": gvk.Group, "version": gvk.Version, "kind": gvk.Kind},
+		}
+		addListMapPatchStrategy(def)
+		defName := definitionName(gvk)
+		s.definitions[defName] = def
+		s.gvks[gvk] = defName
+	}
+	return nil
+}
+
+// AddOpenAPI indexes the definitions of an OpenAPI v2 document in JSON or YAML
+// format. Definitions of Kubernetes kinds are recognised by their
+// x-kubernetes-group-version-kind extension.
+func (s *Schemas) AddOpenAPI(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var doc struct {
+		Definitions map[string]map[string]interface{} `json:"definitions"`
+	}
+	err := yaml2.Unmarshal(data, &doc)
+	if err != nil {
+		return err
+	}
+	for defName, def := range doc.Definitions {
+		addListMapPatchStrategy(def)
+		s.definitions[defName] = def
+		for _, gvk := range definitionGVKs(def) {
+			s.gvks[gvk] = defName
+		}
+	}
+	return nil
+}
+
+func definitionName(gvk schema.GroupVersionKind) string {
+	parts := strings.Split(gvk.Group, ".")
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return strings.Join(append(parts, gvk.Version, gvk.Kind), ".")
+}
+
+func definitionGVKs(def map[string]interface{}) []schema.GroupVersionKind {
+	items, _ := def[extGroupVersionKind].([]interface{})
+	gvks := make([]schema.GroupVersionKind, 0, len(items))
+	for _, item := range items {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		group, _ := m["group"].(string)
+		version, _ := m["version"].(string)
+		kind, _ := m["kind"].(string)
+		gvks = append(gvks, schema.GroupVersionKind{Group: group, Version: version, Kind: kind})
+	}
+	return gvks
+}
+
+// addListMapPatchStrategy marks lists declared as maps with a single key as
+// mergeable by that key, so that both the generated patches and kustomize
+// merge their items instead of replacing the whole list.
+func addListMapPatchStrategy(def map[string]interface{}) {
+	if def["type"] == "array" && def[extListType] == "map" {
+		keys, _ := def[extListMapKeys].([]interface{})
+		if _, ok := def[extPatchStrategy]; !ok && len(keys) == 1 {
+			def[extPatchStrategy] = "merge"
+			def[extPatchMergeKey] = keys[0]
+		}
+	}
+	for _, field := range []string{"items", "additionalProperties"} {
+		if sub, ok := def[field].(map[string]interface{}); ok {
+			addListMapPatchStrategy(sub)
+		}
+	}
+	if props, ok := def["properties"].(map[string]interface{}); ok {
+		for _, prop := range props {
+			if sub, ok := prop.(map[string]interface{}); ok {
+				addListMapPatchStrategy(sub)
+			}
+		}
+	}
+}
+
+// Has returns true if the schema of the given kind is known.
+func (s *Schemas) Has(gvk schema.GroupVersionKind) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.gvks[gvk]
+	return ok
+}
+
+// PatchMeta returns the strategic merge patch metadata for the given kind
+// derived from its schema, or nil if the schema is not known.
+func (s *Schemas) PatchMeta(gvk schema.GroupVersionKind) strategicpatch.LookupPatchMeta {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	defName, ok := s.gvks[gvk]
+	if !ok {
+		return nil
+	}
+	return openAPIPatchMeta{
+		schema: s.toProto(s.definitions[defName], proto.NewPath(gvk.Kind), sets.NewString(defName)),
+	}
+}
+
+// toProto converts a JSON schema into the model used to look up patch
+// metadata. Maps and fields of unknown structure become arbitrary values, which
+// are patched as a whole.
+func (s *Schemas) toProto(def map[string]interface{}, path proto.Path, seen sets.String) proto.Schema {
+	base := proto.BaseSchema{
+		Extensions: map[string]interface{}{},
+		Path:       path,
+	}
+	for k, v := range def {
+		if strings.HasPrefix(k, "x-") {
+			base.Extensions[k] = v
+		}
+	}
+
+	if ref, ok := def["$ref"].(string); ok {
+		defName := strings.TrimPrefix(ref, definitionRefPrefix)
+		refDef, ok := s.definitions[defName]
+		if !ok || seen.Has(defName) {
+			return &proto.Arbitrary{BaseSchema: base}
+		}
+		return s.toProto(refDef, path, sets.NewString(seen.List()...).Insert(defName))
+	}
+
+	switch def["type"] {
+	case "object", nil:
+		props, ok := def["properties"].(map[string]interface{})
+		if !ok || len(props) == 0 {
+			return &proto.Arbitrary{BaseSchema: base}
+		}
+		kind := &proto.Kind{
+			BaseSchema: base,
+			Fields:     map[string]proto.Schema{},
+		}
+		for name, prop := range props {
+			if sub, ok := prop.(map[string]interface{}); ok {
+				kind.Fields[name] = s.toProto(sub, path.FieldPath(name), seen)
+				kind.FieldOrder = append(kind.FieldOrder, name)
+			}
+		}
+		sort.Strings(kind.FieldOrder)
+		return kind
+	case "array":
+		items, ok := def["items"].(map[string]interface{})
+		if !ok {
+			return &proto.Arbitrary{BaseSchema: base}
+		}
+		return &proto.Array{
+			BaseSchema: base,
+			SubType:    s.toProto(items, path.ArrayPath(0), seen),
+		}
+	default:
+		t, _ := def["type"].(string)
+		format, _ := def["format"].(string)
+		return &proto.Primitive{
+			BaseSchema: base,
+			Type:       t,
+			Format:     format,
+		}
+	}
+}
+
+// openAPIPatchMeta looks up patch metadata in an OpenAPI schema. Unlike
+// strategicpatch.PatchMetaFromOpenAPI, fields missing from the schema are not
+// an error; they are patched as a whole.
+type openAPIPatchMeta struct {
+	schema proto.Schema
+}
+
+var _ strategicpatch.LookupPatchMeta = openAPIPatchMeta{}
+
+func (m openAPIPatchMeta) LookupPatchMetadataForStruct(key string) (strategicpatch.LookupPatchMeta, strategicpatch.PatchMeta, error) {
+	if m.schema == nil {
+		return openAPIPatchMeta{}, strategicpatch.PatchMeta{}, nil
+	}
+	sub, meta, err := strategicpatch.NewPatchMetaFromOpenAPI(m.schema).LookupPatchMetadataForStruct(key)
+	if err != nil {
+		return openAPIPatchMeta{}, strategicpatch.PatchMeta{}, nil
+	}
+	return openAPIPatchMeta{schema: sub.(strategicpatch.PatchMetaFromOpenAPI).Schema}, meta, nil
+}
+
+func (m openAPIPatchMeta) LookupPatchMetadataForSlice(key string) (strategicpatch.LookupPatchMeta, strategicpatch.PatchMeta, error) {
+	if m.schema == nil {
+		return openAPIPatchMeta{}, strategicpatch.PatchMeta{}, nil
+	}
+	sub, meta, err := strategicpatch.NewPatchMetaFromOpenAPI(m.schema).LookupPatchMetadataForSlice(key)
+	if err != nil {
+		return openAPIPatchMeta{}, strategicpatch.PatchMeta{}, nil
+	}
+	return openAPIPatchMeta{schema: sub.(strategicpatch.PatchMetaFromOpenAPI).Schema}, meta, nil
+}
+
+func (m openAPIPatchMeta) Name() string {
+	if m.schema == nil {
+		return ""
+	}
+	return m.schema.GetName()
+}
+
+// Document returns an OpenAPI document for the kustomize openapi field. Since
+// kustomize replaces its builtin schema with the given one, the document holds
+// the definitions of all the kinds listed, custom or builtin, and of the
+// definitions they refer to. Definitions of other kinds are left out, so the
+// document does not depend on the variants processed before.
+func (s *Schemas) Document(kinds []schema.GroupVersionKind) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.loadBuiltin()
+	if err != nil {
+		return nil, err
+	}
+
+	definitions := map[string]interface{}{}
+	var collect func(defName string)
+	collect = func(defName string) {
+		if _, ok := definitions[defName]; ok {
+			return
+		}
+		def, ok := s.definitions[defName]
+		if !ok {
+			def, ok = s.builtin[defName]
+			if !ok {
+				return
+			}
+		}
+		definitions[defName] = def
+		for _, ref := range definitionRefs(def) {
+			collect(ref)
+		}
+	}
+	for _, gvk := range kinds {
+		if defName, ok := s.gvks[gvk]; ok {
+			collect(defName)
+		} else if defName, ok := s.builtinGVKs[gvk]; ok {
+			collect(defName)
+		}
+	}
+
+	return json.MarshalIndent(map[string]interface{}{
+		"swagger":     "2.0",
+		"info":        map[string]interface{}{"title": "Kubernetes", "version": "v0.0.0"},
+		"paths":       map[string]interface{}{},
+		"definitions": definitions,
+	}, "", "  ")
+}
+
+func definitionRefs(def interface{}) []string {
+	var refs []string
+	switch v := def.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if ref, ok := val.(string); ok && k == "$ref" && strings.HasPrefix(ref, definitionRefPrefix) {
+				refs = append(refs, strings.TrimPrefix(ref, definitionRefPrefix))
+			} else {
+				refs = append(refs, definitionRefs(val)...)
+			}
+		}
+	case []interface{}:
+		for _, val := range v {
+			refs = append(refs, definitionRefs(val)...)
+		}
+	}
+	return refs
+}
+
+// loadBuiltin indexes the Kubernetes OpenAPI schema bundled with kustomize.
+func (s *Schemas) loadBuiltin() error {
+	if s.builtin != nil {
+		return nil
+	}
+	version := kubernetesapi.DefaultOpenAPI
+	data := kubernetesapi.OpenAPIMustAsset[version](filepath.Join("kubernetesapi", version, "swagger.json"))
+	var doc struct {
+		Definitions map[string]map[string]interface{} `json:"definitions"`
+	}
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		return err
+	}
+	s.builtin = doc.Definitions
+	s.builtinGVKs = map[schema.GroupVersionKind]string{}
+	for defName, def := range doc.Definitions {
+		for _, gvk := range definitionGVKs(def) {
+			s.builtinGVKs[gvk] = defName
+		}
+	}
+	return nil
+}
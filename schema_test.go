@@ -0,0 +1,105 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func newCRD(kind string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apiextensions.k8s.io/v1",
+		"kind":       "CustomResourceDefinition",
+		"spec": map[string]interface{}{
+			"group": "example.com",
+			"names": map[string]interface{}{"kind": kind},
+			"versions": []interface{}{
+				map[string]interface{}{
+					"name": "v1",
+					"schema": map[string]interface{}{
+						"openAPIV3Schema": map[string]interface{}{"type": "object"},
+					},
+				},
+			},
+		},
+	}}
+}
+
+func TestSchemasDocument(t *testing.T) {
+	foo := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Foo"}
+	configMap := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+
+	cases := []struct {
+		name    string
+		kinds   []schema.GroupVersionKind
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "custom kind",
+			kinds:   []schema.GroupVersionKind{foo},
+			want:    []string{"com.example.v1.Foo"},
+			notWant: []string{"com.example.v1.Bar", "io.k8s.api.core.v1.ConfigMap"},
+		},
+		{
+			name:    "builtin kind with its references",
+			kinds:   []schema.GroupVersionKind{configMap},
+			want:    []string{"io.k8s.api.core.v1.ConfigMap", "io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta"},
+			notWant: []string{"com.example.v1.Foo", "com.example.v1.Bar"},
+		},
+		{
+			name:    "unknown kind",
+			kinds:   []schema.GroupVersionKind{{Group: "example.com", Version: "v1", Kind: "Baz"}},
+			notWant: []string{"com.example.v1.Foo", "com.example.v1.Bar"},
+		},
+	}
+
+	s := NewSchemas()
+	for _, kind := range []string{"Foo", "Bar"} {
+		if err := s.AddCRD(newCRD(kind)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			data, err := s.Document(c.kinds)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var doc struct {
+				Definitions map[string]interface{} `json:"definitions"`
+			}
+			if err := json.Unmarshal(data, &doc); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range c.want {
+				if _, ok := doc.Definitions[name]; !ok {
+					t.Errorf("definition %s is missing", name)
+				}
+			}
+			for _, name := range c.notWant {
+				if _, ok := doc.Definitions[name]; ok {
+					t.Errorf("unexpected definition %s", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,558 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/kustomize/api/filesys"
+	"sigs.k8s.io/kustomize/api/types"
+	yaml2 "sigs.k8s.io/yaml"
+)
+
+// originAnnotation marks the objects passed through kustomize while rendering
+// a transformed base, so that they can be traced back to their input.
+const originAnnotation = "kustomizer.kmodules.xyz/origin"
+
+// Transforms are the kustomize transformers inferred for a variant. They are
+// applied to every object of the generated overlay.
+type Transforms struct {
+	Namespace         string
+	NamePrefix        string
+	NameSuffix        string
+	CommonLabels      map[string]string
+	CommonAnnotations map[string]string
+	Images            []types.Image
+	Replicas          []types.Replica
+}
+
+func (t Transforms) IsZero() bool {
+	return !t.renames() && len(t.CommonLabels) == 0 && len(t.CommonAnnotations) == 0 &&
+		len(t.Images) == 0 && len(t.Replicas) == 0
+}
+
+// renames returns true if the transformers change the keys of objects.
+func (t Transforms) renames() bool {
+	return t.Namespace != "" || t.NamePrefix != "" || t.NameSuffix != ""
+}
+
+// Apply sets the transformers in cfg.
+func (t Transforms) Apply(cfg *types.Kustomization) {
+	cfg.Namespace = t.Namespace
+	cfg.NamePrefix = t.NamePrefix
+	cfg.NameSuffix = t.NameSuffix
+	if len(t.CommonLabels) > 0 {
+		cfg.CommonLabels = t.CommonLabels
+	}
+	if len(t.CommonAnnotations) > 0 {
+		cfg.CommonAnnotations = t.CommonAnnotations
+	}
+	cfg.Images = t.Images
+	cfg.Replicas = t.Replicas
+}
+
+// TransformedBase holds the objects of the bases of a variant as they look
+// once the overlay transformers are applied.
+type TransformedBase struct {
+	Transforms Transforms
+	// Resources are the transformed base objects keyed by their transformed key.
+	Resources map[ObjKey]*unstructured.Unstructured
+	// Origins maps the keys of Resources to the keys of the base objects they
+	// were rendered from.
+	Origins map[ObjKey]ObjKey
+	// Additions maps the keys of variant objects that do not exist in the
+	// bases to the object that has to be added to the overlay to produce them.
+	Additions map[ObjKey]*unstructured.Unstructured
+	// Renamed maps the keys of variant objects that are renamed base objects to
+	// the transformed base object before the rename.
+	Renamed map[ObjKey]*unstructured.Unstructured
+
+	// renderedAdditions are the Additions after applying the transformers.
+	renderedAdditions map[ObjKey]*unstructured.Unstructured
+}
+
+// RenderFunc renders the objects of a base, in the order of their keys, with
+// the transformers t. The results are indexed like those of renderTransformed.
+type RenderFunc func(t Transforms) (map[int]*unstructured.Unstructured, error)
+
+// NewTransformedBase returns the base of a variant without any transformers.
+func NewTransformedBase(base, target map[ObjKey]*unstructured.Unstructured) *TransformedBase {
+	tb := &TransformedBase{
+		Resources: base,
+		Origins:   map[ObjKey]ObjKey{},
+		Additions: map[ObjKey]*unstructured.Unstructured{},
+	}
+	for objKey := range base {
+		tb.Origins[objKey] = objKey
+	}
+	for objKey, obj := range target {
+		if _, ok := base[objKey]; !ok {
+			tb.Additions[objKey] = obj
+		}
+	}
+	return tb
+}
+
+// TransformBase infers the transformers that turn the base objects into the
+// objects of the variant. Namespace and name transformers are only used when
+// they match more objects than the plain base, and labels and annotations are
+// dropped when the variant does not carry them everywhere kustomize sets them.
+// Once objects are matched, changed container images and replica counts are
+// lifted into images and replicas transformers. render renders the base
+// objects with the transformers tried.
+func TransformBase(base, target map[ObjKey]*unstructured.Unstructured, render RenderFunc) (*TransformedBase, error) {
+	tb, err := transformMetadata(base, target, render)
+	if err != nil {
+		return nil, err
+	}
+
+	t := tb.Transforms
+	t.Images = inferImages(tb.Resources, target)
+	if len(t.Images) > 0 {
+		transformed, err := transformBase(base, target, t, render)
+		if err != nil {
+			return nil, err
+		}
+		if transformed != nil {
+			tb = transformed
+		}
+	}
+
+	t = tb.Transforms
+	t.Replicas = inferReplicas(tb, target)
+	for len(t.Replicas) > 0 {
+		transformed, err := transformBase(base, target, t, render)
+		if err != nil {
+			return nil, err
+		}
+		if transformed == nil {
+			break
+		}
+		conflicts := transformed.replicaConflicts(target)
+		if conflicts.Len() == 0 {
+			return transformed, nil
+		}
+		replicas := t.Replicas[:0:0]
+		for _, r := range t.Replicas {
+			if !conflicts.Has(r.Name) {
+				replicas = append(replicas, r)
+			}
+		}
+		t.Replicas = replicas
+	}
+	return tb, nil
+}
+
+// transformMetadata infers the namespace, name, label and annotation
+// transformers of the variant.
+func transformMetadata(base, target map[ObjKey]*unstructured.Unstructured, render RenderFunc) (*TransformedBase, error) {
+	t := inferTransforms(base, target)
+	for !t.IsZero() {
+		tb, err := transformBase(base, target, t, render)
+		if err != nil {
+			return nil, err
+		}
+		if t.renames() && (tb == nil || countMatches(tb.Resources, target) <= countMatches(base, target)) {
+			t.Namespace, t.NamePrefix, t.NameSuffix = "", "", ""
+			continue
+		}
+		if tb == nil {
+			break
+		}
+		labels, annotations := tb.conflicts(target)
+		if labels.Len() == 0 && annotations.Len() == 0 {
+			return tb, nil
+		}
+		for _, k := range labels.List() {
+			delete(t.CommonLabels, k)
+		}
+		for _, k := range annotations.List() {
+			delete(t.CommonAnnotations, k)
+		}
+	}
+	return NewTransformedBase(base, target), nil
+}
+
+// transformBase applies t to the base objects and the objects added by the
+// variant. It returns nil if kustomize can not apply t or the added objects can
+// not be expressed in the transformed overlay.
+func transformBase(base, target map[ObjKey]*unstructured.Unstructured, t Transforms, render RenderFunc) (*TransformedBase, error) {
+	var inputs []*unstructured.Unstructured
+	var inputKeys []ObjKey
+	for _, objKey := range SortedKeys(base) {
+		inputs = append(inputs, base[objKey])
+		inputKeys = append(inputKeys, objKey)
+	}
+	rendered, err := render(t)
+	if err != nil {
+		// kustomize can not apply the inferred transformers
+		return nil, nil
+	}
+	tb := &TransformedBase{
+		Transforms:        t,
+		Resources:         map[ObjKey]*unstructured.Unstructured{},
+		Origins:           map[ObjKey]ObjKey{},
+		Additions:         map[ObjKey]*unstructured.Unstructured{},
+		renderedAdditions: map[ObjKey]*unstructured.Unstructured{},
+	}
+	for i, obj := range rendered {
+		objKey := NewObjKey(obj)
+		tb.Resources[objKey] = obj
+		tb.Origins[objKey] = inputKeys[i]
+	}
+
+	// the variant objects missing from the transformed base are added to the
+	// overlay, named so that the transformers produce their variant names
+	numBase := len(inputs)
+	for _, objKey := range SortedKeys(target) {
+		if _, ok := tb.Resources[objKey]; !ok {
+			inputs = append(inputs, t.Reverse(target[objKey]))
+			inputKeys = append(inputKeys, objKey)
+		}
+	}
+	if len(inputs) == numBase {
+		return tb, nil
+	}
+	rendered, err = renderTransformed(inputs, t, nil, nil, nil)
+	if err != nil {
+		// the added objects collide with base objects
+		return nil, nil
+	}
+	for i := numBase; i < len(inputs); i++ {
+		obj, ok := rendered[i]
+		if !ok || NewObjKey(obj) != inputKeys[i] {
+			// the added object would not be produced under its variant name
+			return nil, nil
+		}
+		tb.Additions[inputKeys[i]] = inputs[i]
+		tb.renderedAdditions[inputKeys[i]] = obj
+	}
+	return tb, nil
+}
+
+// conflicts returns the common labels and annotations that kustomize sets on
+// fields where the variant has a different value or none at all. Patches are
+// applied before these transformers and can not undo them.
+func (tb *TransformedBase) conflicts(target map[ObjKey]*unstructured.Unstructured) (sets.String, sets.String) {
+	labels := sets.NewString()
+	annotations := sets.NewString()
+	for _, resources := range []map[ObjKey]*unstructured.Unstructured{tb.Resources, tb.renderedAdditions} {
+		for objKey, obj := range resources {
+			targetObj, ok := target[objKey]
+			if !ok {
+				continue
+			}
+			patch, err := generateJsonPatch(obj, targetObj)
+			if err != nil {
+				continue
+			}
+			for _, op := range patch {
+				if op.Operation == "add" {
+					continue
+				}
+				// the changed field or any key inside it may have been set
+				// by the transformers
+				var value interface{} = obj.Object
+				var field string
+				for _, part := range strings.Split(op.Path, "/")[1:] {
+					field = strings.NewReplacer("~1", "/", "~0", "~").Replace(part)
+					value = childValue(value, field)
+				}
+				keys := sets.NewString(field)
+				collectKeys(value, keys)
+				for _, k := range keys.List() {
+					if _, ok := tb.Transforms.CommonLabels[k]; ok {
+						labels.Insert(k)
+					}
+					if _, ok := tb.Transforms.CommonAnnotations[k]; ok {
+						annotations.Insert(k)
+					}
+				}
+			}
+		}
+	}
+	return labels, annotations
+}
+
+// childValue returns the map entry or list item of v addressed by part.
+func childValue(v interface{}, part string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v[part]
+	case []interface{}:
+		i, err := strconv.Atoi(part)
+		if err != nil || i < 0 || i >= len(v) {
+			return nil
+		}
+		return v[i]
+	}
+	return nil
+}
+
+// collectKeys adds the map keys found anywhere in v to keys.
+func collectKeys(v interface{}, keys sets.String) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			keys.Insert(k)
+			collectKeys(child, keys)
+		}
+	case []interface{}:
+		for _, child := range v {
+			collectKeys(child, keys)
+		}
+	}
+}
+
+// inferTransforms guesses the namespace and name prefix and suffix of a
+// variant by comparing the objects that do not exist in both base and target,
+// and the labels and annotations it adds to every object.
+func inferTransforms(base, target map[ObjKey]*unstructured.Unstructured) Transforms {
+	t := Transforms{
+		CommonLabels:      commonAdditions(base, target, (*unstructured.Unstructured).GetLabels),
+		CommonAnnotations: commonAdditions(base, target, (*unstructured.Unstructured).GetAnnotations),
+	}
+
+	var removed, added []ObjKey
+	for _, objKey := range SortedKeys(base) {
+		if _, ok := target[objKey]; !ok {
+			removed = append(removed, objKey)
+		}
+	}
+	for _, objKey := range SortedKeys(target) {
+		if _, ok := base[objKey]; !ok {
+			added = append(added, objKey)
+		}
+	}
+	if len(removed) == 0 || len(added) == 0 {
+		return t
+	}
+
+	// count the prefix and suffix pairs that turn removed names into added
+	// names of the same kind
+	type affix struct {
+		prefix, suffix string
+	}
+	counts := map[affix]int{}
+	for _, r := range removed {
+		found := map[affix]bool{}
+		for _, a := range added {
+			if a.Group != r.Group || a.Kind != r.Kind || len(a.Name) <= len(r.Name) {
+				continue
+			}
+			for i := 0; i+len(r.Name) <= len(a.Name); i++ {
+				if a.Name[i:i+len(r.Name)] == r.Name {
+					found[affix{prefix: a.Name[:i], suffix: a.Name[i+len(r.Name):]}] = true
+				}
+			}
+		}
+		for af := range found {
+			counts[af]++
+		}
+	}
+	candidates := make([]affix, 0, len(counts))
+	for af := range counts {
+		candidates = append(candidates, af)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if counts[candidates[i]] != counts[candidates[j]] {
+			return counts[candidates[i]] > counts[candidates[j]]
+		}
+		if candidates[i].prefix != candidates[j].prefix {
+			return candidates[i].prefix < candidates[j].prefix
+		}
+		return candidates[i].suffix < candidates[j].suffix
+	})
+	if len(candidates) > 0 {
+		t.NamePrefix = candidates[0].prefix
+		t.NameSuffix = candidates[0].suffix
+	}
+
+	// every namespaced object of the variant must live in the same namespace
+	namespaces := map[string]bool{}
+	for objKey := range target {
+		if objKey.Namespace != "" {
+			namespaces[objKey.Namespace] = true
+		}
+	}
+	if len(namespaces) == 1 {
+		for ns := range namespaces {
+			for objKey := range base {
+				if objKey.Namespace == ns {
+					continue
+				}
+				// base objects without a namespace may be cluster scoped,
+				// so they only count if the variant moved them into ns,
+				// renamed or not
+				moved := objKey
+				moved.Namespace = ns
+				_, ok := target[moved]
+				moved.Name = t.NamePrefix + objKey.Name + t.NameSuffix
+				_, renamed := target[moved]
+				if objKey.Namespace != "" || ok || renamed {
+					t.Namespace = ns
+					break
+				}
+			}
+		}
+	}
+	return t
+}
+
+// commonAdditions returns the metadata entries that every variant object has
+// but at least one base object lacks.
+func commonAdditions(base, target map[ObjKey]*unstructured.Unstructured, get func(*unstructured.Unstructured) map[string]string) map[string]string {
+	var common map[string]string
+	for _, objKey := range SortedKeys(target) {
+		values := get(target[objKey])
+		if common == nil {
+			common = map[string]string{}
+			for k, v := range values {
+				common[k] = v
+			}
+			continue
+		}
+		for k, v := range common {
+			if values[k] != v {
+				delete(common, k)
+			}
+		}
+	}
+	for k, v := range common {
+		added := false
+		for _, obj := range base {
+			if value, ok := get(obj)[k]; !ok || value != v {
+				added = true
+				break
+			}
+		}
+		if !added {
+			delete(common, k)
+		}
+	}
+	return common
+}
+
+// Reverse returns a copy of obj named so that applying the transformers
+// produces obj again.
+func (t Transforms) Reverse(obj *unstructured.Unstructured) *unstructured.Unstructured {
+	out := obj.DeepCopy()
+	name := out.GetName()
+	if len(name) > len(t.NamePrefix)+len(t.NameSuffix) &&
+		strings.HasPrefix(name, t.NamePrefix) &&
+		strings.HasSuffix(name, t.NameSuffix) {
+		out.SetName(name[len(t.NamePrefix) : len(name)-len(t.NameSuffix)])
+	}
+	return out
+}
+
+// renderTransformed applies the transformers to objs with kustomize and
+// returns the results indexed by the position of the input they came from.
+// patches and jsonPatches are added to the patches and patchesJson6902 fields
+// of the kustomization, openAPI is the schema of custom resources, if any.
+func renderTransformed(objs []*unstructured.Unstructured, t Transforms, patches, jsonPatches []types.Patch, openAPI []byte) (map[int]*unstructured.Unstructured, error) {
+	var buf []byte
+	for i, obj := range objs {
+		in := obj.DeepCopy()
+		annotations := in.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[originAnnotation] = strconv.Itoa(i)
+		in.SetAnnotations(annotations)
+		data, err := yaml2.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, []byte("---\n")...)
+		buf = append(buf, data...)
+	}
+
+	cfg := types.Kustomization{
+		TypeMeta: types.TypeMeta{
+			APIVersion: types.KustomizationVersion,
+			Kind:       types.KustomizationKind,
+		},
+		Resources: []string{"resources.yaml"},
+	}
+	t.Apply(&cfg)
+	cfg.Patches = patches
+	cfg.PatchesJson6902 = jsonPatches
+	if openAPI != nil {
+		cfg.OpenAPI = map[string]string{"path": "openapi.json"}
+	}
+	data, err := yaml2.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	const dir = "/transform"
+	fs := filesys.MakeFsInMemory()
+	err = fs.MkdirAll(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = fs.WriteFile(dir+"/resources.yaml", buf)
+	if err != nil {
+		return nil, err
+	}
+	err = fs.WriteFile(dir+"/kustomization.yaml", data)
+	if err != nil {
+		return nil, err
+	}
+	if openAPI != nil {
+		err = fs.WriteFile(dir+"/openapi.json", openAPI)
+		if err != nil {
+			return nil, err
+		}
+	}
+	resources, err := Build(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	out := map[int]*unstructured.Unstructured{}
+	for _, obj := range resources {
+		annotations := obj.GetAnnotations()
+		i, err := strconv.Atoi(annotations[originAnnotation])
+		if err != nil {
+			return nil, err
+		}
+		delete(annotations, originAnnotation)
+		if len(annotations) == 0 {
+			unstructured.RemoveNestedField(obj.Object, "metadata", "annotations")
+		} else {
+			obj.SetAnnotations(annotations)
+		}
+		out[i] = obj
+	}
+	return out, nil
+}
+
+func countMatches(resources, target map[ObjKey]*unstructured.Unstructured) int {
+	var n int
+	for objKey := range resources {
+		if _, ok := target[objKey]; ok {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,197 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func decodeObjects(t *testing.T, data string) map[ObjKey]*unstructured.Unstructured {
+	t.Helper()
+	resources := map[ObjKey]*unstructured.Unstructured{}
+	if err := DecodeResources([]byte(data), resources); err != nil {
+		t.Fatal(err)
+	}
+	return resources
+}
+
+const inferBase = `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+`
+
+func TestInferTransforms(t *testing.T) {
+	cases := []struct {
+		name       string
+		base       string
+		target     string
+		namespace  string
+		namePrefix string
+		nameSuffix string
+	}{
+		{
+			name: "namespace",
+			base: inferBase,
+			target: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: prod
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: prod
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: prod
+`,
+			namespace: "prod",
+		},
+		{
+			name: "name prefix",
+			base: inferBase,
+			target: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: prod-config
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: prod-web
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: prod-web
+`,
+			namePrefix: "prod-",
+		},
+		{
+			name: "namespace and name prefix",
+			base: inferBase,
+			target: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: prod-config
+  namespace: prod
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: prod-web
+  namespace: prod
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: prod-web
+  namespace: prod
+`,
+			namespace:  "prod",
+			namePrefix: "prod-",
+		},
+		{
+			name: "namespace and name suffix",
+			base: inferBase,
+			target: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config-v2
+  namespace: prod
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web-v2
+  namespace: prod
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web-v2
+  namespace: prod
+`,
+			namespace:  "prod",
+			nameSuffix: "-v2",
+		},
+		{
+			name: "cluster scoped object",
+			base: `
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: reader
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+`,
+			target: `
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: reader
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: extra
+  namespace: prod
+`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tr := inferTransforms(decodeObjects(t, c.base), decodeObjects(t, c.target))
+			if tr.Namespace != c.namespace {
+				t.Errorf("namespace: got %q, want %q", tr.Namespace, c.namespace)
+			}
+			if tr.NamePrefix != c.namePrefix {
+				t.Errorf("name prefix: got %q, want %q", tr.NamePrefix, c.namePrefix)
+			}
+			if tr.NameSuffix != c.nameSuffix {
+				t.Errorf("name suffix: got %q, want %q", tr.NameSuffix, c.nameSuffix)
+			}
+		})
+	}
+}
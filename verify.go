@@ -0,0 +1,197 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/kustomize/api/filesys"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/kyaml/openapi"
+	"sigs.k8s.io/kustomize/kyaml/openapi/kubernetesapi"
+)
+
+// Verify builds every generated overlay and compares the resulting objects
+// with the resources of the input variant it was generated from.
+func (p *Processor) Verify() error {
+	dstDirs := make([]string, 0, len(p.sources))
+	for dstDir, src := range p.sources {
+		if !src.copied {
+			dstDirs = append(dstDirs, dstDir)
+		}
+	}
+	sort.Strings(dstDirs)
+
+	var failed, skipped int
+	for _, dstDir := range dstDirs {
+		src := p.sources[dstDir]
+		if !src.exact {
+			skipped++
+			continue
+		}
+		mismatches, err := p.verifyDir(src.dir, dstDir)
+		if err != nil {
+			return fmt.Errorf("failed to verify %s: %v", dstDir, err)
+		}
+		if len(mismatches) > 0 {
+			failed++
+			fmt.Printf("%s does not reproduce %s:\n", dstDir, src.dir)
+			for _, m := range mismatches {
+				fmt.Println("  " + m)
+			}
+		}
+	}
+	fmt.Printf("verified %d generated kustomizations, %d failed, %d skipped\n", len(dstDirs)-skipped, failed, skipped)
+	if failed > 0 {
+		return fmt.Errorf("verification failed for %d generated kustomizations", failed)
+	}
+	return nil
+}
+
+func (p *Processor) verifyDir(srcDir, dstDir string) ([]string, error) {
+	srcCfg, err := p.cache.LoadKustomization(filepath.Join(srcDir, "kustomization.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	expected, err := p.cache.LoadObjects(srcDir, srcCfg)
+	if err != nil {
+		return nil, err
+	}
+	actual, err := Build(p.fs, dstDir)
+	if err != nil {
+		return nil, err
+	}
+	// either side may list generated objects as resources under their
+	// hashed names
+	unhashContentNames(expected)
+	unhashContentNames(actual)
+	return compareResources(expected, actual)
+}
+
+// schemaMu guards the OpenAPI schema that kustomize keeps as global state.
+// Every call into kustomize that looks up the schema holds it, but only for
+// as long as the call, so that the rest of the work of concurrent jobs is
+// done in parallel.
+var schemaMu sync.Mutex
+
+// withSchema calls fn holding schemaMu, with openAPI as the schema of
+// kustomize if not empty. kustomize keeps the schema of a kustomization with
+// an openapi field for the following builds, so the builtin schema is
+// restored afterwards.
+func withSchema(openAPI []byte, fn func() error) error {
+	schemaMu.Lock()
+	defer schemaMu.Unlock()
+	defer func() {
+		_ = openapi.SetSchema(map[string]string{"version": kubernetesapi.DefaultOpenAPI}, nil, true)
+	}()
+	if openAPI != nil {
+		if err := openapi.SetSchema(nil, openAPI, true); err != nil {
+			return err
+		}
+	}
+	return fn()
+}
+
+// Build renders the kustomization in dir. Objects generated with a content
+// hash appended to their name are returned under the name they are generated
+// with, which the patches of overlays address, see unhashNames.
+func Build(fs filesys.FileSystem, dir string) (map[ObjKey]*unstructured.Unstructured, error) {
+	data, hashed, err := build(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	resources := map[ObjKey]*unstructured.Unstructured{}
+	err = DecodeResources(data, resources)
+	if err != nil {
+		return nil, err
+	}
+	unhashNames(resources, hashed)
+	return resources, nil
+}
+
+// build renders the kustomization in dir as YAML. It also returns the objects
+// kustomize appended the content hash to, mapped to their names without it.
+func build(fs filesys.FileSystem, dir string) ([]byte, map[ObjKey]string, error) {
+	var m resmap.ResMap
+	err := withSchema(nil, func() error {
+		var err error
+		m, err = krusty.MakeKustomizer(krusty.MakeDefaultOptions()).Run(fs, dir)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	hashed := map[ObjKey]string{}
+	for _, r := range m.Resources() {
+		if !r.NeedHashSuffix() {
+			continue
+		}
+		name := r.GetName()
+		if i := strings.LastIndex(name, "-"); i > 0 {
+			gvk := r.GetGvk()
+			hashed[ObjKey{Group: gvk.Group, Kind: gvk.Kind, Name: name, Namespace: r.GetNamespace()}] = name[:i]
+		}
+	}
+	data, err := m.AsYaml()
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, hashed, nil
+}
+
+// compareResources returns a description of every difference between the
+// expected and actual objects.
+func compareResources(expected, actual map[ObjKey]*unstructured.Unstructured) ([]string, error) {
+	var mismatches []string
+	for objKey, want := range expected {
+		got, ok := actual[objKey]
+		if !ok {
+			mismatches = append(mismatches, fmt.Sprintf("missing %s", objKey))
+			continue
+		}
+		patch, err := generateJsonPatch(got, want)
+		if err != nil {
+			return nil, err
+		}
+		for _, op := range patch {
+			switch op.Operation {
+			case "remove":
+				mismatches = append(mismatches, fmt.Sprintf("%s: unexpected field %s", objKey, op.Path))
+			default:
+				value, err := json.Marshal(op.Value)
+				if err != nil {
+					return nil, err
+				}
+				mismatches = append(mismatches, fmt.Sprintf("%s: field %s should be %s", objKey, op.Path, value))
+			}
+		}
+	}
+	for objKey := range actual {
+		if _, ok := expected[objKey]; !ok {
+			mismatches = append(mismatches, fmt.Sprintf("unexpected %s", objKey))
+		}
+	}
+	sort.Strings(mismatches)
+	return mismatches, nil
+}
@@ -0,0 +1,305 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/kustomize/api/filesys"
+)
+
+// newProcessor returns a processor generating overlays in memory.
+func newProcessor(outputSchema OutputSchema) *Processor {
+	p := NewProcessor(filesys.MakeFsInMemory())
+	p.OutputSchema = outputSchema
+	return p
+}
+
+// writeTree writes files to a temporary input directory and returns it.
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	rootDir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(rootDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rootDir
+}
+
+// processTree writes files to a temporary input directory and generates the
+// overlays of its profile below /out with p.
+func processTree(t *testing.T, p *Processor, files map[string]string, vars ...Variable) *Processor {
+	t.Helper()
+	rootDir := writeTree(t, files)
+	if err := p.Schemas.Load(rootDir, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddCRDs(rootDir, vars); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ProcessBases(rootDir, "/out", vars); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ProcessDir(rootDir, "", "/out", vars); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+const verifyKustomization = `
+bases:
+- ../../base
+resources:
+- all.yaml
+`
+
+const verifyDeployment = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  selector:
+    matchLabels:
+      app: web
+  template:
+    metadata:
+      labels:
+        app: web
+    spec:
+      containers:
+      - name: web
+        image: nginx
+        env:
+        - name: A
+          value: "1"
+        ports:
+        - containerPort: 80
+        volumeMounts:
+        - name: data
+          mountPath: /data
+      volumes:
+      - name: data
+        emptyDir: {}
+`
+
+const verifyCRD = `
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: foos.example.com
+spec:
+  group: example.com
+  names:
+    kind: Foo
+    plural: foos
+  scope: Namespaced
+  versions:
+  - name: v1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            properties:
+              items:
+                type: array
+                x-kubernetes-list-type: map
+                x-kubernetes-list-map-keys: [name]
+                items:
+                  type: object
+                  properties:
+                    name: {type: string}
+                    value: {type: string}
+`
+
+const verifyFoo = `
+apiVersion: example.com/v1
+kind: Foo
+metadata:
+  name: one
+spec:
+  items:
+  - name: a
+    value: "1"
+  - name: b
+    value: "1"
+`
+
+func TestVerifyMergedListOrder(t *testing.T) {
+	cases := []struct {
+		name string
+		// crds are added to the base only
+		crds     string
+		resource string
+		// the variant replaces old with new in resource
+		old, new string
+	}{
+		{
+			name:     "appended env var",
+			resource: verifyDeployment,
+			old:      "          value: \"1\"\n",
+			new:      "          value: \"1\"\n        - name: B\n          value: \"2\"\n",
+		},
+		{
+			name:     "appended port",
+			resource: verifyDeployment,
+			old:      "        - containerPort: 80\n",
+			new:      "        - containerPort: 80\n        - containerPort: 443\n",
+		},
+		{
+			name:     "appended volume",
+			resource: verifyDeployment,
+			old:      "        emptyDir: {}\n",
+			new:      "        emptyDir: {}\n      - name: cache\n        emptyDir: {}\n",
+		},
+		{
+			name:     "appended custom resource item",
+			crds:     verifyCRD,
+			resource: verifyFoo,
+			old:      "  - name: b\n    value: \"1\"\n",
+			new:      "  - name: b\n    value: \"1\"\n  - name: c\n    value: \"3\"\n",
+		},
+	}
+
+	for _, c := range cases {
+		for _, outputSchema := range []OutputSchema{OutputSchemaLegacy, OutputSchemaUnified} {
+			t.Run(c.name+"/"+string(outputSchema), func(t *testing.T) {
+				p := processTree(t, newProcessor(outputSchema), map[string]string{
+					"base/kustomization.yaml":       "resources:\n- all.yaml\n",
+					"base/all.yaml":                 c.crds + "---" + c.resource,
+					"variants/a/kustomization.yaml": verifyKustomization,
+					"variants/a/all.yaml":           strings.Replace(c.resource, c.old, c.new, 1),
+				}, Variable{Base: "base"}, Variable{Dir: "variants"})
+				if err := p.Verify(); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
+
+const hashedBase = `
+resources:
+- deploy.yaml
+configMapGenerator:
+- name: cfg
+  literals:
+  - A=1
+  - B=2
+`
+
+const hashedDeployment = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  selector:
+    matchLabels:
+      app: web
+  template:
+    metadata:
+      labels:
+        app: web
+    spec:
+      containers:
+      - name: web
+        image: nginx
+        envFrom:
+        - configMapRef:
+            name: cfg
+`
+
+func TestVerifyHashedGenerators(t *testing.T) {
+	cases := []struct {
+		name    string
+		variant map[string]string
+	}{
+		{
+			name: "changed key",
+			variant: map[string]string{
+				"kustomization.yaml": "bases:\n- ../../base\nconfigMapGenerator:\n- name: cfg\n  behavior: merge\n  literals:\n  - B=3\n",
+			},
+		},
+		{
+			name: "added generator",
+			variant: map[string]string{
+				"kustomization.yaml": "bases:\n- ../../base\nconfigMapGenerator:\n- name: extra\n  literals:\n  - X=1\n",
+			},
+		},
+		{
+			name: "unchanged generator",
+			variant: map[string]string{
+				"kustomization.yaml": "bases:\n- ../../base\nimages:\n- name: nginx\n  newTag: \"1.21\"\n",
+			},
+		},
+		{
+			name: "resources with hashed names",
+			variant: map[string]string{
+				"kustomization.yaml": "bases:\n- ../../base\nresources:\n- all.yaml\n",
+				"all.yaml": strings.Replace(hashedDeployment, "name: cfg\n", "name: cfg-2cfbcb2mhm\n", 1) + `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cfg-2cfbcb2mhm
+data:
+  A: "1"
+  B: "3"
+`,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		for _, outputSchema := range []OutputSchema{OutputSchemaLegacy, OutputSchemaUnified} {
+			for _, generators := range []bool{false, true} {
+				name := c.name + "/" + string(outputSchema)
+				if generators {
+					name += "/generators"
+				}
+				t.Run(name, func(t *testing.T) {
+					files := map[string]string{
+						"base/kustomization.yaml": hashedBase,
+						"base/deploy.yaml":        hashedDeployment,
+					}
+					for name, data := range c.variant {
+						files["variants/a/"+name] = data
+					}
+					p := newProcessor(outputSchema)
+					p.Generators = generators
+					processTree(t, p, files, Variable{Base: "base"}, Variable{Dir: "variants"})
+					if err := p.Verify(); err != nil {
+						t.Error(err)
+					}
+				})
+			}
+		}
+	}
+}